@@ -0,0 +1,40 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// openCapture creates a file in the -capture-dir directory for the
+// output of a run, named for the time, and deletes the oldest files
+// beyond the last -capture-keep. It returns nil if -capture-dir is not
+// set or the file cannot be created.
+func openCapture() *os.File {
+	if *captureDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*captureDir, 0777); err != nil {
+		log.Print(err)
+		return nil
+	}
+	name := filepath.Join(*captureDir, "watch-"+time.Now().Format("20060102-150405.000")+".log")
+	f, err := os.Create(name)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	old, _ := filepath.Glob(filepath.Join(*captureDir, "watch-*.log"))
+	sort.Strings(old) // the names sort by time
+	for len(old) > *captureKeep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return f
+}
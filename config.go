@@ -0,0 +1,88 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configFiles returns the files that may hold default flag settings,
+// in order of preference.
+func configFiles() []string {
+	files := []string{".watchrc"}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".config", "Watch", "config"))
+	}
+	return files
+}
+
+// loadConfig sets flags from the first config file that exists.
+// Each line has the form "name = value"; blank lines and lines
+// beginning with # are ignored. Flags given on the command line
+// are parsed afterward and so override the file.
+func loadConfig() error {
+	for _, name := range configFiles() {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for n := 1; s.Scan(); n++ {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return fmt.Errorf("%s:%d: missing =", name, n)
+			}
+			key = strings.TrimSpace(key)
+			if err := flag.Set(key, strings.TrimSpace(value)); err != nil {
+				return fmt.Errorf("%s:%d: %v", name, n, err)
+			}
+		}
+		return s.Err()
+	}
+	return nil
+}
+
+// readEnvFile returns the environment variables defined in the named
+// file, one "KEY=VALUE" per line, as for -env-file. Blank lines and
+// lines beginning with # are ignored, and a value may be quoted.
+func readEnvFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var env []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: want KEY=VALUE", name, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, s.Err()
+}
@@ -0,0 +1,85 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// stream is where -events writes lifecycle events, or nil.
+var stream struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// A streamEvent is one line of the -events stream.
+// Output is encoded in base64, as encoding/json does for []byte.
+type streamEvent struct {
+	Event    string    `json:"event"` // run_start, run_output, or run_end
+	Run      int       `json:"run"`
+	Time     time.Time `json:"time"`
+	Command  string    `json:"command,omitempty"`
+	Output   []byte    `json:"output,omitempty"`
+	Exit     *int      `json:"exit,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // in seconds
+}
+
+// openStream directs the -events stream to the named file,
+// or to standard output if name is "-".
+func openStream(name string) error {
+	if name == "-" {
+		stream.w = os.Stdout
+		return nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	stream.w = f
+	return nil
+}
+
+// emit writes e to the -events stream, if any.
+func emit(e streamEvent) {
+	if stream.w == nil {
+		return
+	}
+	e.Time = time.Now()
+	b, _ := json.Marshal(e)
+	stream.Lock()
+	defer stream.Unlock()
+	stream.w.Write(append(b, '\n'))
+}
+
+// emitStart and emitEnd report the start and end of a command of run id.
+func emitStart(id int, name string) {
+	emit(streamEvent{Event: "run_start", Run: id, Command: name})
+}
+
+func emitEnd(id int, name string, err error, d time.Duration) {
+	code := exitCode(err)
+	emit(streamEvent{Event: "run_end", Run: id, Command: name, Exit: &code, Duration: d.Seconds()})
+}
+
+// teeEvents returns a writer that copies to w and reports what it
+// writes as output of run id on the -events stream, if any.
+func teeEvents(w io.Writer, id int) io.Writer {
+	if stream.w == nil {
+		return w
+	}
+	return io.MultiWriter(w, outputEvents(id))
+}
+
+// outputEvents reports what is written to it as output of a run.
+type outputEvents int
+
+func (id outputEvents) Write(p []byte) (int, error) {
+	emit(streamEvent{Event: "run_output", Run: int(id), Output: p})
+	return len(p), nil
+}
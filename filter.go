@@ -0,0 +1,300 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"9fans.net/go/acme"
+)
+
+// logOps is the set of operations reported by the acme log.
+var logOps = map[string]bool{
+	"new":   true,
+	"zerox": true,
+	"get":   true,
+	"put":   true,
+	"del":   true,
+	"focus": true,
+}
+
+// A filter decides which acme log events trigger a run.
+type filter struct {
+	ops      map[string]bool
+	roots    []string // watched directories
+	prefixes []string // roots and the forms they take through symlinks
+	only     []onlyPattern
+	ignore   []*regexp.Regexp
+	exts     []string        // -ext suffixes, such as .go
+	files    map[string]bool // if non-empty, the only files watched
+	base     string          // with -relative, the directory names are matched relative to
+}
+
+// An onlyPattern is a compiled -only pattern.
+type onlyPattern struct {
+	re       *regexp.Regexp
+	match    func(string) bool // reports whether a name matches re
+	anywhere bool              // re names its own scope; ignore roots
+}
+
+// newFilter returns the filter described by the command-line flags,
+// with relative directories resolved against pwd.
+func newFilter(pwd string) (*filter, error) {
+	f := &filter{ops: make(map[string]bool), files: make(map[string]bool)}
+	for _, op := range strings.Split(*opList, ",") {
+		if !logOps[op] {
+			return nil, fmt.Errorf("unknown -ops operation %q", op)
+		}
+		f.ops[op] = true
+	}
+	for _, only := range onlyPatterns() {
+		only = os.ExpandEnv(only)
+		re, err := regexp.Compile(only)
+		if err != nil {
+			return nil, err
+		}
+		// An -only pattern anchored to an absolute path names its own scope.
+		f.only = append(f.only, onlyPattern{re, matcher(only, re), strings.HasPrefix(only, "^/")})
+	}
+	if *extList != "" {
+		for _, ext := range strings.Split(*extList, ",") {
+			if ext = strings.TrimPrefix(strings.TrimSpace(ext), "."); ext != "" {
+				f.exts = append(f.exts, "."+ext)
+			}
+		}
+	}
+	for _, ignore := range ignores {
+		re, err := regexp.Compile(ignore)
+		if err != nil {
+			return nil, err
+		}
+		f.ignore = append(f.ignore, re)
+	}
+	if *relative {
+		f.base = pwd
+	}
+	f.roots = []string{pwd}
+	if len(dirs) > 0 {
+		f.roots = nil
+		for _, d := range dirs {
+			if !filepath.IsAbs(d) {
+				d = filepath.Join(pwd, d)
+			}
+			f.roots = append(f.roots, filepath.Clean(d))
+		}
+	}
+	for _, root := range f.roots {
+		f.prefixes = append(f.prefixes, root)
+		if real, err := filepath.EvalSymlinks(root); err == nil && real != root {
+			f.prefixes = append(f.prefixes, real)
+		}
+	}
+	for _, name := range files {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(pwd, name)
+		}
+		f.files[filepath.Clean(name)] = true
+	}
+	return f, nil
+}
+
+// reject returns the reason e should not trigger a run,
+// or the empty string if it should.
+func (f *filter) reject(e *acme.LogEvent) string {
+	switch {
+	case e.Name == "":
+		return "no file name"
+	case !f.ops[e.Op]:
+		return "op " + e.Op + " not watched"
+	}
+	if why := f.rejectName(e.Name); why != "" {
+		return why
+	}
+	switch {
+	case *useGitignore && gitignored(e.Name):
+		return "ignored by .gitignore"
+	case *hashContent && e.Op == "put" && unchanged(e.Name):
+		return "content unchanged"
+	}
+	return ""
+}
+
+// rejectName returns the reason a file named name is not watched,
+// or the empty string if it is. With -file, only the named files are;
+// otherwise, files in scope that match the patterns.
+func (f *filter) rejectName(name string) string {
+	if len(f.files) > 0 {
+		if !f.watches(name) {
+			return "not a watched file"
+		}
+		return ""
+	}
+	switch {
+	case !f.inScope(name):
+		return "outside watched directories"
+	case !f.matches(name):
+		return "does not match -only"
+	case !f.hasExt(name):
+		return "does not match -ext"
+	case f.ignored(name):
+		return "matches -ignore"
+	}
+	return ""
+}
+
+// inScope reports whether name lies under the watched directories
+// or some -only pattern names its own scope.
+func (f *filter) inScope(name string) bool {
+	if underRoot(name, f.prefixes) {
+		return true
+	}
+	for _, p := range f.only {
+		if p.anywhere {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether name matches an -only pattern that applies
+// to it: any pattern under the watched directories, and only those
+// naming their own scope elsewhere.
+func (f *filter) matches(name string) bool {
+	under := underRoot(name, f.prefixes)
+	rel := relativeTo(f.base, name)
+	for _, p := range f.only {
+		if (under || p.anywhere) && p.match(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasExt reports whether name ends in one of the -ext extensions,
+// or whether -ext is unset.
+func (f *filter) hasExt(name string) bool {
+	if len(f.exts) == 0 {
+		return true
+	}
+	for _, ext := range f.exts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored reports whether name matches an -ignore pattern.
+func (f *filter) ignored(name string) bool {
+	rel := relativeTo(f.base, name)
+	for _, re := range f.ignore {
+		if re.MatchString(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// watches reports whether name is one of the -file files, either by
+// name or by being the same file. The watched names are resolved again
+// each time, since an editor that saves by renaming a new file over
+// the old one leaves the name in place but changes the file behind it.
+func (f *filter) watches(name string) bool {
+	name = filepath.Clean(name)
+	if f.files[name] {
+		return true
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	for file := range f.files {
+		if fi, err := os.Stat(file); err == nil && os.SameFile(fi, info) {
+			return true
+		}
+	}
+	return false
+}
+
+// matcher returns a function reporting whether a name matches re,
+// compiled from pattern. For the default .*, which matches any name,
+// and for patterns that only match a literal suffix, such as \.go$,
+// which are common and are matched against every event, it avoids the
+// regexp.
+func matcher(pattern string, re *regexp.Regexp) func(string) bool {
+	prog, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return re.MatchString
+	}
+	prog = prog.Simplify()
+	switch {
+	case prog.Op == syntax.OpStar && prog.Sub[0].Op == syntax.OpAnyCharNotNL,
+		prog.Op == syntax.OpEmptyMatch:
+		return func(string) bool { return true }
+	case prog.Op == syntax.OpConcat && len(prog.Sub) == 2 &&
+		prog.Sub[0].Op == syntax.OpLiteral && prog.Sub[0].Flags&syntax.FoldCase == 0 &&
+		prog.Sub[1].Op == syntax.OpEndText:
+		suffix := string(prog.Sub[0].Rune)
+		return func(name string) bool { return strings.HasSuffix(name, suffix) }
+	}
+	return re.MatchString
+}
+
+// relativeTo returns name relative to base if it lies beneath it,
+// and name itself otherwise or if base is empty.
+func relativeTo(base, name string) string {
+	if base == "" {
+		return name
+	}
+	if rel, ok := strings.CutPrefix(name, strings.TrimSuffix(base, "/")+"/"); ok {
+		return rel
+	}
+	return name
+}
+
+// With -root, a file named under acmeRoot in acme is the file of the
+// same name under localRoot, the current directory, here.
+var localRoot, acmeRoot string
+
+// localName returns the local name of the file acme calls name.
+func localName(name string) string {
+	return swapRoot(name, acmeRoot, localRoot)
+}
+
+// acmeName returns the name acme knows the local file name by.
+func acmeName(name string) string {
+	return swapRoot(name, localRoot, acmeRoot)
+}
+
+// swapRoot returns name with the directory from at its start replaced
+// by to, or name itself if it does not lie beneath from.
+func swapRoot(name, from, to string) string {
+	if from == "" || from == to {
+		return name
+	}
+	if name == from {
+		return to
+	}
+	if rel, ok := strings.CutPrefix(name, strings.TrimSuffix(from, "/")+"/"); ok {
+		return filepath.Join(to, rel)
+	}
+	return name
+}
+
+// underRoot reports whether name lies under any of the watched roots.
+func underRoot(name string, roots []string) bool {
+	name = filepath.Clean(name)
+	for _, root := range roots {
+		if name == root || strings.HasPrefix(name, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	patterns := []string{
+		// Matched without the regexp.
+		`.*`,
+		``,
+		`\.go$`,
+		`go$`,
+		`_test\.go$`,
+		// Near misses, left to the regexp.
+		`(?i)\.go$`,
+		`(?m)\.go$`,
+		`(?s).*`,
+		`^.*$`,
+		`.+`,
+		`\.go`,
+		`^\.go$`,
+		`\.(go|c)$`,
+		`\.go$|\.c$`,
+		`[.]go$`,
+	}
+	names := []string{
+		"",
+		"/a/b.go",
+		"/a/b.GO",
+		"/a/b_test.go",
+		"/x.c",
+		"/go/x",
+		"/a/b.go.orig",
+		"a\nb.go",
+		"b.go\nx",
+		".go",
+	}
+	for _, p := range patterns {
+		re := regexp.MustCompile(p)
+		match := matcher(p, re)
+		for _, n := range names {
+			if got, want := match(n), re.MatchString(n); got != want {
+				t.Errorf("matcher(%#q)(%q) = %v, want %v", p, n, got, want)
+			}
+		}
+	}
+}
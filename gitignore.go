@@ -0,0 +1,204 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ignoreRule is one pattern from a .gitignore file.
+type ignoreRule struct {
+	re     *regexp.Regexp
+	negate bool // pattern began with !
+	dir    bool // pattern ended with /, matching only directories
+	base   bool // pattern has no /, matching the last path element
+}
+
+// An ignoreFile is a parsed .gitignore file.
+type ignoreFile struct {
+	mtime time.Time
+	rules []ignoreRule
+}
+
+var ignoreCache struct {
+	sync.Mutex
+	files map[string]*ignoreFile // by directory
+}
+
+// gitignored reports whether name, an absolute file name, is ignored
+// by the .gitignore files of the git repository holding it. Each
+// directory from the repository root down to the file may hold a
+// .gitignore, whose rules apply to the files beneath it and override
+// those of the directories above. A file in an ignored directory is
+// ignored. Files outside a git repository are never ignored.
+func gitignored(name string) bool {
+	root := repoRoot(filepath.Dir(name))
+	if root == "" {
+		return false
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range elems {
+		if elems[i] == ".git" {
+			return true
+		}
+		// Check each directory on the way down, then the file itself.
+		if ignoredBelow(root, elems[:i+1], i < len(elems)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredBelow reports whether the path root/elems, a directory if
+// isDir is set, is ignored by the .gitignore files from root down to
+// the path's parent directory. The last matching rule wins.
+func ignoredBelow(root string, elems []string, isDir bool) bool {
+	ignored := false
+	dir := root
+	for i := 0; i < len(elems); i++ {
+		if f := loadIgnore(dir); f != nil {
+			rel := strings.Join(elems[i:], "/")
+			base := elems[len(elems)-1]
+			for _, r := range f.rules {
+				if r.dir && !isDir {
+					continue
+				}
+				target := rel
+				if r.base {
+					target = base
+				}
+				if r.re.MatchString(target) {
+					ignored = !r.negate
+				}
+			}
+		}
+		dir = filepath.Join(dir, elems[i])
+	}
+	return ignored
+}
+
+// repoRoot returns the root of the git repository holding dir,
+// or the empty string if there is none.
+func repoRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadIgnore returns the parsed .gitignore in dir, or nil if there is none.
+// Parsed files are cached until they change.
+func loadIgnore(dir string) *ignoreFile {
+	name := filepath.Join(dir, ".gitignore")
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil
+	}
+	ignoreCache.Lock()
+	defer ignoreCache.Unlock()
+	if f := ignoreCache.files[dir]; f != nil && f.mtime.Equal(fi.ModTime()) {
+		return f
+	}
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+	f := &ignoreFile{mtime: fi.ModTime()}
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		if r, ok := parseIgnoreRule(s.Text()); ok {
+			f.rules = append(f.rules, r)
+		}
+	}
+	if ignoreCache.files == nil {
+		ignoreCache.files = make(map[string]*ignoreFile)
+	}
+	ignoreCache.files[dir] = f
+	return f
+}
+
+// parseIgnoreRule parses one line of a .gitignore file.
+// It reports false for blank lines, comments, and bad patterns.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	var r ignoreRule
+	line = strings.TrimRight(line, " \t")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false
+	}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	line = strings.TrimPrefix(line, "\\")
+	if strings.HasSuffix(line, "/") {
+		r.dir = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	r.base = !strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	re, err := regexp.Compile("^" + globRegexp(line) + "$")
+	if err != nil {
+		return r, false
+	}
+	r.re = re
+	return r, true
+}
+
+// globRegexp translates a .gitignore glob into a regular expression.
+// A * or ? does not match /, while ** matches any number of
+// directories.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(glob[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,85 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitignored(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, data string) {
+		name = filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(".git/HEAD", "")
+	write(".gitignore", "# comment\n*.log\n!keep.log\nbuild/\n/top.txt\ndocs/**/*.tmp\nsub/deep/\n")
+	write("sub/.gitignore", "!b.log\n")
+	write("sub/build", "") // a file, not a directory
+
+	tests := []struct {
+		name    string
+		ignored bool
+	}{
+		{"main.go", false},
+		{".git/config", true},
+
+		// Negation, in the same file and in a .gitignore below.
+		{"a.log", true},
+		{"sub/a.log", true},
+		{"keep.log", false},
+		{"sub/keep.log", false},
+		{"b.log", true},
+		{"sub/b.log", false},
+
+		// Directory-only patterns.
+		{"build/out.o", true},
+		{"sub/build/out.o", true},
+		{"sub/build", false},
+
+		// Anchored patterns.
+		{"top.txt", true},
+		{"sub/top.txt", false},
+		{"sub/deep/x.go", true},
+		{"other/sub/deep/x.go", false},
+
+		// ** matches any number of directories, including none.
+		{"docs/a.tmp", true},
+		{"docs/x/y/a.tmp", true},
+		{"a.tmp", false},
+		{"other/docs/a.tmp", false},
+	}
+	for _, tt := range tests {
+		if got := gitignored(filepath.Join(root, tt.name)); got != tt.ignored {
+			t.Errorf("gitignored(%q) = %v, want %v", tt.name, got, tt.ignored)
+		}
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob, re string
+	}{
+		{"*.go", `[^/]*\.go`},
+		{"a?c", `a[^/]c`},
+		{"**/x", `(?:.*/)?x`},
+		{"a/**", `a/.*`},
+		{"[!ab]c", `[^ab]c`},
+		{"[ab", `\[ab`},
+		{`\*x`, `\*x`},
+	}
+	for _, tt := range tests {
+		if got := globRegexp(tt.glob); got != tt.re {
+			t.Errorf("globRegexp(%q) = %#q, want %#q", tt.glob, got, tt.re)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"sync"
+)
+
+// hashes records, with -hash, the content hash of each file as of the
+// last write that triggered a run, and as last seen by unchanged.
+var hashes struct {
+	sync.Mutex
+	sum  map[string][sha256.Size]byte
+	seen map[string][sha256.Size]byte
+}
+
+// unchanged reports whether the named file holds the same content as
+// when a write of it last triggered a run. Files larger than
+// -hash-max-size, and files that cannot be read, are never reported
+// unchanged. The hash is kept until accepted by hashAccepted.
+func unchanged(name string) bool {
+	info, err := os.Stat(name)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > *hashMaxSize {
+		return false
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(data)
+	hashes.Lock()
+	defer hashes.Unlock()
+	if hashes.seen == nil {
+		hashes.seen = make(map[string][sha256.Size]byte)
+	}
+	hashes.seen[name] = sum
+	old, ok := hashes.sum[name]
+	return ok && old == sum
+}
+
+// hashAccepted records the hash unchanged last saw for the named file
+// as that of its content, once a write of it is accepted for a run.
+// A write dropped later, as during -restart-delay, so leaves the old
+// hash in place, and the next write with the same content still runs.
+func hashAccepted(name string) {
+	hashes.Lock()
+	defer hashes.Unlock()
+	sum, ok := hashes.seen[name]
+	if !ok {
+		return
+	}
+	if hashes.sum == nil {
+		hashes.sum = make(map[string][sha256.Size]byte)
+	}
+	hashes.sum[name] = sum
+	delete(hashes.seen, name)
+}
@@ -6,22 +6,437 @@
 //
 // Usage:
 //
-//	Watch [-only pattern] cmd [args...]
+//	Watch [-only pattern] [-ignore pattern] [-dir dir]... cmd [args...] [-- cmd [args...]]...
 //
 // Watch opens a new acme window named for the current directory
 // with a suffix of /+watch. The window shows the execution of the given
 // command. Each time a file in that directory changes, Watch reexecutes
-// the command and updates the window.
+// the command and updates the window. Unless -run-on-start=false,
+// Watch also runs the command once at startup, after waiting for
+// -start-delay if it is set; changes during the wait are not lost,
+// but run no sooner. When the command finishes, Watch reports its
+// exit status and running time, as in "$ (exit 0, 1.2s)". The -quiet
+// flag omits the "$ cmd" line that otherwise precedes the command's
+// output.
 //
-// TODO: dump state
+// Several commands, separated by --, may be given. Watch then runs
+// each in its own window, named +watch.1, +watch.2, and so on, and
+// reruns all of them on each change.
+//
+// The -dir flag, which may be repeated, watches the named directories
+// instead of the current one; the window is then named for the first
+// of them. The -name flag replaces the +watch suffix, or the whole
+// window name if it is an absolute path.
+//
+// With -watch-self, Watch also reruns the command when its executable,
+// found as $PATH lookup would find it, is rebuilt or replaced.
+//
+// With -reuse, Watch takes over an existing window of the same name,
+// such as one left behind by an earlier Watch, emptying it rather than
+// opening a second window.
+//
+// Each {} in the arguments is replaced by the name of the file whose
+// change triggered the run, as in
+//
+//	Watch -only '\.go$' gofmt -l {}
+//
+// For the initial run and runs started from the tag, which have no such
+// file, an argument that is exactly {} is dropped.
+//
+// An argument that is exactly {...} is replaced by the names of all the
+// files changed since the previous run started, in the order they
+// first changed, each as a separate argument, as in
+//
+//	Watch -only '\.go$' gofmt -w {...}
+//
+// The same list, one name per line, is in $WATCH_FILES.
+//
+// The text matched by the groups of the -only pattern, or of the first
+// matching one if -only is repeated, in the changed file's name is in
+// $WATCH_MATCH_1, $WATCH_MATCH_2, and so on, and replaces {1}, {2},
+// and so on in the arguments, so that
+//
+//	Watch -only '/cmd/(\w+)/' go install ./cmd/{1}
+//
+// reinstalls only the command whose source changed.
+//
+// With -go-pkg, {} is instead replaced by the directory of the changed
+// file's Go package, so that
+//
+//	Watch -go-pkg go test {}
+//
+// tests only the package that changed. Changes to files other than Go
+// source are treated like runs with no triggering file.
+//
+// The command's environment describes the run. For a run triggered by
+// a file change, $samfile and $% hold the file's name and $winid the
+// id of its acme window. $WATCH_OP holds the acme log operation that
+// triggered the run, or "manual" for the initial run and runs started
+// from the tag, and $WATCH_PATTERN holds the -only pattern, or the
+// patterns, one per line, if -only is repeated.
+//
+// The -env-file flag names a file of further variables, one KEY=VALUE
+// per line, with # beginning a comment line. They override inherited
+// variables of the same name, and later lines override earlier ones.
+//
+// The command runs in the current directory, or with -cwd in the given
+// directory, taken relative to the current one. The -cwd flag does not
+// change which directory is watched or how the window is named.
+//
+// With -shell, the arguments are joined and run by $SHELL -c
+// (or /bin/sh if $SHELL is unset), so pipes and redirection work.
+// The -shell-cmd flag names another interpreter, which like sh and rc
+// must take -c, as in
+//
+//	Watch -shell -shell-cmd rc 'walk | grep ...'
+//
+// The hooks given by -pre and -post run the same way.
+//
+// With -stdin, Watch reads a shell script from standard input at
+// startup and runs it with sh -c in place of a command, as in
+//
+//	echo 'go build && go test' | Watch -stdin
+//
+// The commands Watch runs read from the null device, so that a command
+// expecting input fails at once rather than hanging. With -stdin-tty
+// they instead share Watch's standard input. So that they can read the
+// terminal, they then run in Watch's own process group, and Stop and
+// Kill, and the ending of superseded commands, signal only the command
+// itself, not processes it started.
+//
+// After each run the window scrolls back to the top of the output.
+// With -follow it instead tracks the end of the output as it arrives,
+// and with -no-scroll it leaves the scroll position alone.
+//
+// By default the window is cleared at the start of each run.
+// With -clear=onsuccess, earlier output is kept until a run succeeds,
+// so the output of a failing run stays visible while the next one runs.
+// With -buffer, Watch holds each run's output until the run ends and
+// then replaces the window's contents with it in one write, so that a
+// quick command does not leave the window empty for a moment.
+//
+// With -seq, each argument is a separate shell command, and Watch runs
+// them in order, stopping at the first that fails, as in
+//
+//	Watch -seq 'go build' 'go vet' 'go test'
+//
+// With -first-match-only as well, Watch marks the failed command after
+// its output, as in "# failed: go vet", and lists the commands skipped
+// after it, one "# skipped:" line each, to show at a glance which step
+// of the sequence broke.
+//
+// The -pre and -post flags give shell commands to run before and after
+// the command each time, with output shown along with the command's.
+// If the -pre command fails, the command is skipped and the run fails
+// as if the command had: the bell rings, the -on-error command runs,
+// and so on. The -post command runs whatever the outcome, with
+// $WATCH_STATUS set to ok or fail.
+// The -on-error command runs, before -post, only when the command
+// fails, with its exit status in $WATCH_EXIT, as in
+//
+//	Watch -on-error 'import -window root fail.png' make test
+//
+// Output is written to the window a line at a time as it arrives, so
+// that a line built up a character at a time, as by a progress bar,
+// appears whole. With -line-buffer=false, Watch instead writes output
+// as it arrives, and -highlight may miss lines split across writes.
+// For commands that print a great deal, -flush batches output arriving
+// within the given interval into a single write, which keeps acme
+// responsive.
+//
+// Acme does not interpret ANSI escape sequences, so programs that
+// color their output leave garbage in the window. The -strip-ansi flag
+// removes such sequences from the output. With -t, it is off by default
+// so that the terminal can render them.
+//
+// With -fallback-term, if acme is not running, Watch warns and behaves
+// as with -t, and it polls for changes as with -poll=1s in place of
+// reading the acme log. The same command line then works inside and
+// outside acme.
+//
+// With -t, Watch reports a command that fails to start on standard
+// error, and exits at once if the command cannot be found on the first
+// run, since that is almost always a mistake in the command line.
+// Otherwise output is handled as in the window: -highlight, -wrap,
+// -max-output, -summary-only, -flush, and -line-buffer apply to
+// standard output and standard error alike, the failure report of
+// -summary-only ending with the last lines of each, and each
+// command is echoed before it runs, unless -quiet, and followed by its
+// exit status, both on standard error.
+// Before each run, Watch also prints a banner with the time, as in
+// "--- 15:04:05", to mark where one run's output ends and the next
+// begins; -banner=false omits it, for clean piping.
+//
+// With -t, -label gives text to prefix each line of output, so that
+// several instances of Watch can share a terminal, as in
+//
+//	Watch -t -label '[build] ' make
+//
+// With -once, Watch runs the command a single time, without watching
+// for changes, and exits with the command's exit status.
+//
+// With -propagate-exit, Watch exits with the exit status of the last
+// completed run rather than 0 when its window is deleted or it is
+// interrupted. On interrupt, Watch kills any running command and
+// deletes its window before exiting.
+//
+// With -max-runs, Watch exits once the command has completed the
+// given number of runs, counting the initial one, after printing the
+// duration of each run to standard error. This makes a simple benchmark
+// of incremental rebuilds.
+//
+// With -log, Watch appends a line to the named file as each run
+// finishes, holding a JSON object with the run's start time,
+// triggering file, command, exit status, and duration in seconds.
+//
+// With -events, Watch writes a line to the named file, or to standard
+// output if the name is -, for each event in the life of each command
+// it runs: a JSON object with an "event" field of run_start, run_output,
+// or run_end. Output is base64-encoded in the "output" field, and
+// run_end carries "exit" and "duration" fields. With -t, which sends
+// the command's output to standard output, use a file instead.
+//
+// With -timeout, a command that runs longer than the given duration is killed.
+//
+// Commands that are superseded by a new run, time out, or are still
+// running when Watch exits are sent SIGKILL. The -kill-signal flag
+// names another signal to send instead, such as TERM, to let them
+// clean up. With -kill-grace, a command still running after the given
+// duration is then sent SIGKILL.
+//
+// With -bell, Watch rings the terminal bell each time the command fails.
+// For other notifications, -notify gives a shell command to start after
+// each run, without waiting for it, with $WATCH_STATUS set to ok or
+// fail, $WATCH_DURATION to the run's length in seconds, and $WATCH_FILE
+// to the name of the file that triggered it, as in
+//
+//	Watch -notify 'notify-send "build $WATCH_STATUS"' make
+//
+// If the connection to the acme log drops, Watch reconnects with
+// increasing delays, logging each attempt, and exits after -log-retries
+// consecutive failures.
+//
+// With -split-streams, Watch opens a second window, named with a
+// further .err suffix, for the command's standard error, leaving only
+// its standard output in the main window. With -t, standard output and
+// standard error always stay separate.
+//
+// With -title-status, Watch appends the state of the run to the window
+// name: :running while the command runs, then :ok or :fail.
+//
+// Acme has no colors, so to make lines of interest stand out, -highlight
+// prefixes each output line matching the given regular expression with
+// the -marker text, as in
+//
+//	Watch -highlight 'FAIL|panic:' go test
+//
+// With -capture-dir, Watch also saves the full output of each run,
+// including any hooks, to a file in the given directory named for the
+// time of the run, such as watch-20240102-150405.000.log, keeping the
+// files of the last -capture-keep runs. The window's output of a run
+// is lost when the next run clears it; its file is not.
+//
+// With -wrap, Watch breaks output lines longer than the given number
+// of characters, for programs that assume a terminal of fixed width.
+//
+// With -max-output, Watch shows at most the given number of bytes of
+// each run's output, followed by a line noting the truncation, and
+// discards the rest.
+//
+// With -max-lines, Watch deletes the oldest lines of the window as
+// output arrives, keeping it no longer than the given number of lines.
+//
+// With -summary-only, Watch holds back the command's output and shows
+// only the status line of each run, preceded, if the run fails, by the
+// last -tail lines of its output.
+//
+// With -no-window-on-success, Watch opens its window only when a run
+// fails, showing that run's output, and deletes the window again after
+// a run succeeds.
+//
+// The window's tag holds commands to control the run. Get reruns the
+// command as for the initial run, with no triggering file; Again reruns
+// it as for the last file change that triggered a run, whose name follows
+// the commands in the tag so that it can be opened with a right click.
+// Stop asks the running command to exit (with SIGTERM) and
+// Kill kills it outright; neither starts another run. Clear empties
+// the window. Reload rereads the -env-file and, if it can, reruns the
+// command.
+// (The environment Watch inherited cannot change after it starts, so to
+// pass a changed variable to the command, put it in the -env-file.)
+// Del kills the running command, with any processes it started, before
+// deleting the window. With -keepalive, Del instead refuses to delete
+// the window while a command is running, so that a watched server is not
+// ended by accident; Stop or Kill it first.
+//
+// By default only files written with Put trigger a rerun.
+// The -ops flag selects other acme log operations instead, as a
+// comma-separated list of new, zerox, get, put, del, and focus.
+//
+// Changes are debounced: the command reruns only once no further
+// matching file has changed, and Get has not been clicked, for the
+// -debounce interval (default 100ms). Editors that save by writing a
+// temporary file and renaming it over the original produce several
+// events for one save; Watch maps temporary and backup names back to
+// the file being saved and ignores further events for a file shortly
+// after a run for it if the file has not changed since.
+//
+// A command that writes files it is watching can rerun itself forever.
+// With -restart-delay, file changes are ignored for the given duration
+// after each run finishes, breaking such loops. Whether or not it is set,
+// Watch logs a warning when a file that changed during a run changes
+// again just after the run ends, a likely sign of such a loop.
+//
+// With -run-unique, a change that would rerun the command with the
+// same command line as the run still in progress, as when a file is
+// saved twice in a row with {} in the arguments, does not restart it:
+// the run in progress goes on, and the command runs once more when it
+// ends, so that it sees the latest content. Changes made meanwhile are
+// collapsed into that one rerun, and listed in {...} and $WATCH_FILES.
+// A change that yields a different command line restarts the run as
+// usual.
+// Get always restarts it; Again, which repeats the last change, is
+// treated like the change.
+//
+// With -restart-on-exit, a command that exits on its own, rather than
+// being stopped, superseded, or timed out by Watch, is run again after
+// the -restart-delay, or at least 0.1s. This keeps a watched server
+// running even if it crashes between changes. A command that keeps
+// exiting within 10s of starting is restarted after longer and longer
+// delays, doubling up to 30s, and one that cannot be started at all is
+// not restarted.
+//
+// The -only and -ignore flags restrict which files trigger a rerun.
+// A file must match -only and must not match -ignore; -ignore wins
+// when both match. Either flag may be repeated, and a file then needs
+// to match only one of the patterns, so that
+//
+//	Watch -only '\.go$' -only '\.templ$' -only '\.sql$' make
+//
+// reruns for changes to any of the three kinds of file. The -ext flag
+// is a shorthand for the common case, a comma-separated list of file
+// extensions, so that the same can be written
+//
+//	Watch -ext go,templ,sql make
+//
+// A file must then have one of the extensions and, if -only is also
+// given, match -only as well.
+//
+// Patterns are matched against absolute file names, or, with -relative,
+// against names relative to the current directory for files beneath it,
+// so that a pattern cannot match by accident on the directories above it.
+// Normally only files under the watched directories are considered,
+// but an -only pattern beginning with ^/ is anchored to an absolute
+// path and replaces the directory check for that pattern, so that
+//
+//	Watch -only '^/home/me/(src|gen)/.*\.go$' make
+//
+// watches two sibling trees regardless of the current directory.
+//
+// With -hash, Watch keeps a hash of the content of each file written
+// and ignores a put that leaves the content unchanged, as when an editor
+// saves a file it has not modified. Files larger than -hash-max-size
+// are not hashed and always trigger a run.
+//
+// Watch normally learns of changes from the acme log, which reports
+// only files written from acme. With -poll, it instead scans the watched
+// directories at the given interval and reports any file that has
+// appeared or whose modification time has changed as a put, and any
+// file that has disappeared as a del. This catches changes made
+// outside acme, such as by generators or version control.
+//
+// With -gitignore, files that git would ignore, according to the
+// .gitignore files of the repository holding them, never trigger a
+// rerun. Files outside a git repository are unaffected.
+//
+// Acme reports files by the names it knows them by. When those differ
+// from the names Watch sees, as for a tree edited through a 9p mount
+// on another machine, -root gives the acme name of the current
+// directory. Watch then translates the names acme reports under it to
+// the local names of the same files, which are what the filters, {},
+// $samfile, and $WATCH_FILES see, and names the window and shows the
+// changed file in the tag in acme's terms. Symbolic links in the
+// watched directories are also taken into account.
+//
+// The -file flag, which may be repeated, names individual files to
+// watch. When it is given, only those files trigger a rerun, and the
+// watched directories and the -only, -ext, and -ignore patterns do not
+// apply, though -gitignore and -hash still do.
+// The files are also recognized by identity rather than by name alone,
+// and looked up again at each event, so a change reported under another
+// name for the same file, or a save that replaces the file by renaming a
+// new one over it, still triggers a rerun.
+//
+// The -v flag logs each file event to standard error, with the reason
+// it was ignored if it does not trigger a run. The -dry-run flag
+// prints the same decisions to standard output, with the command line
+// that would run, but runs nothing and opens no window; it is a safe
+// way to tune the filters.
+//
+// With -confirm, Watch does not rerun the command by itself. Instead,
+// when a change arrives, it adds Run to the tag, or with -t asks on
+// standard error, and reruns only when Run is executed or, with -t,
+// a line is typed on standard input. Any number of changes before
+// then cause one run. Again and -restart-on-exit run at once.
+//
+// With -group, Watch waits until no change has arrived for the given
+// duration, so that a burst of changes such as a global rename causes
+// one run, and begins the output of each run with a line listing the
+// files that changed, as in "# changed: a.go, b.go".
+//
+// With -interval, Watch also reruns the command periodically, whether
+// or not anything has changed. A change arriving close to a tick
+// causes only one run.
+//
+// With -trigger-fifo, each line written to the given named pipe also
+// requests a run, taking the line as the name of the changed file for
+// {}, $samfile, and $WATCH_FILES, with $WATCH_OP set to fifo. An empty
+// line requests a run with no file. Since only one reader gets each
+// line, -trigger-fifo cannot be used with several commands separated
+// by --. With -acme-log=false as well, Watch does not read the acme
+// log at all, and so needs no acme, as in
+//
+//	mkfifo /tmp/build
+//	Watch -t -acme-log=false -trigger-fifo /tmp/build make &
+//	echo main.c >/tmp/build
+//
+// Environment variables in the -only pattern, written $VAR or ${VAR},
+// are expanded before it is compiled, so that
+//
+//	Watch -only '\.(${WATCH_EXT})$' make
+//
+// can be reused across projects. A $ not followed by a name, as in a
+// trailing end-of-text anchor, is left alone.
+//
+// Default flag settings are read from .watchrc in the current directory,
+// or else from $HOME/.config/Watch/config. Each line of the file has the
+// form "name = value", naming a flag without its leading dash;
+// lines beginning with # are comments. Flags on the command line
+// override the file; a repeatable flag, such as -dir, given on the
+// command line replaces all of its values from the file.
+//
+// When Watch shuts down cleanly, because its window was deleted or it
+// received an exit signal, it records its directory and arguments in
+// $HOME/.config/Watch/session. Watch -resume then starts the same
+// session again, from any directory, reading the config file of the
+// session's directory rather than the current one. Sessions run with
+// -dry-run or -stdin are not recorded.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -31,184 +446,1561 @@ import (
 )
 
 var args []string
-var win *acme.Win
+var win *acme.Win // nil if there is no window
+var winTitle string
+var errWin *acme.Win // standard error, with -split-streams
 var needrun = make(chan *acme.LogEvent, 1)
-var pattern = flag.String("only", ".*", "only files that match regular expression")
+var changed = make(chan *acme.LogEvent) // run requests, nil for manual ones
+var rerun = make(chan *acme.LogEvent)   // immediate runs: restarts and Again
+var confirmed = make(chan bool)         // with -confirm, the user's go-ahead
+var done = make(chan int, 1)            // exit status of the run, with -once
+
+// cancelRuns cancels main's context at shutdown, ending the event
+// loops and any run in progress.
+var cancelRuns context.CancelFunc
+var cycles sync.WaitGroup // runs in progress
+
 var term = flag.Bool("t", false, "output stdout/stderr to terminal instead of an acme window")
+var debounceDelay = flag.Duration("debounce", 100*time.Millisecond, "wait for file changes to settle for `duration` before rerunning")
+var shell = flag.Bool("shell", false, "run the command with $SHELL -c (default /bin/sh)")
+var clearMode = flag.String("clear", "start", "clear the window at the `start` of each run, or only `onsuccess`")
+var ring = flag.Bool("bell", false, "ring the terminal bell when the command fails")
+var timeout = flag.Duration("timeout", 0, "kill the command if it runs longer than `duration`")
+var opList = flag.String("ops", "put", "rerun on the comma-separated acme log `ops`")
+var winName = flag.String("name", "+watch", "window `name`, relative to the watched directory unless absolute")
+var runOnStart = flag.Bool("run-on-start", true, "run the command once at startup")
+var follow = flag.Bool("follow", false, "keep the end of the output in view")
+var noScroll = flag.Bool("no-scroll", false, "leave the window's scroll position alone")
+var once = flag.Bool("once", false, "run the command once and exit with its exit status")
+var propagate = flag.Bool("propagate-exit", false, "exit with the exit status of the last run")
+var verbose = flag.Bool("v", false, "log each acme event and whether it triggers a run")
+var pre = flag.String("pre", "", "run shell `command` before each run, skipping the run if it fails")
+var post = flag.String("post", "", "run shell `command` after each run, with $WATCH_STATUS set to ok or fail")
+var logFile = flag.String("log", "", "append a JSON record of each run to `file`")
+var flushDelay = flag.Duration("flush", 0, "batch window output written within `interval` into one write")
+var stripANSI = flag.Bool("strip-ansi", false, "remove ANSI escape sequences, such as colors, from the output")
+var restartDelay = flag.Duration("restart-delay", 0, "ignore file changes for `duration` after each run")
+var quiet = flag.Bool("quiet", false, "do not echo the command before its output")
+var goPkg = flag.Bool("go-pkg", false, "replace {} with the Go package directory of the changed file")
+var maxRuns = flag.Int("max-runs", 0, "exit after the command has run `n` times")
+var killSignal = flag.String("kill-signal", "KILL", "end superseded commands with `signal`")
+var killGrace = flag.Duration("kill-grace", 0, "send SIGKILL if a command is still running `duration` after -kill-signal")
+var pollInterval = flag.Duration("poll", 0, "find changes by scanning the watched files every `interval` instead of reading the acme log")
+var workDir = flag.String("cwd", "", "run the command in directory `dir`")
+var eventsFile = flag.String("events", "", "write a JSON stream of run events to `file` (- for standard output)")
+var useGitignore = flag.Bool("gitignore", false, "ignore files ignored by git")
+var restartOnExit = flag.Bool("restart-on-exit", false, "restart the command when it exits on its own, after -restart-delay")
+var hideOnSuccess = flag.Bool("no-window-on-success", false, "show the window only while the last run failed")
+var logRetries = flag.Int("log-retries", 5, "give up after `n` consecutive failures to reconnect to the acme log")
+var titleStatus = flag.Bool("title-status", false, "show the run state at the end of the window name")
+var summaryOnly = flag.Bool("summary-only", false, "show only the status of each run, and the end of its output if it fails")
+var tailLines = flag.Int("tail", 20, "with -summary-only, show the last `n` lines of a failed run")
+var fromStdin = flag.Bool("stdin", false, "read the command from standard input, as a shell script")
+var stdinTTY = flag.Bool("stdin-tty", false, "let commands read Watch's standard input")
+var startDelay = flag.Duration("start-delay", 0, "wait `duration` before the initial run")
+var reuse = flag.Bool("reuse", false, "take over an existing window of the same name instead of opening another")
+var envFile = flag.String("env-file", "", "add the KEY=VALUE variables in `file` to the command's environment")
+var extraEnv []string // from -env-file; guarded by run
+var watchSelf = flag.Bool("watch-self", false, "also rerun when the command's executable changes")
+var maxLines = flag.Int("max-lines", 0, "keep at most `n` lines in the window, deleting the oldest")
+var dryRun = flag.Bool("dry-run", false, "print which events would trigger a run, and the command, without running anything")
+var highlight = flag.String("highlight", "", "mark output lines matching `regexp`")
+var marker = flag.String("marker", ">> ", "with -highlight, the `text` to prefix matching lines")
+var highlightRE *regexp.Regexp
+var onlyREs []*regexp.Regexp // the compiled -only patterns
+var matchBase string         // with -relative, the directory patterns are relative to
+var label = flag.String("label", "", "with -t, prefix each output line with `text`")
+var triggerFIFO = flag.String("trigger-fifo", "", "also run for each line written to the named pipe `fifo`")
+var acmeLog = flag.Bool("acme-log", true, "find changes by reading the acme log")
+var interval = flag.Duration("interval", 0, "also run every `duration`, changes or not")
+var captureDir = flag.String("capture-dir", "", "save the output of each run to a file in `dir`")
+var captureKeep = flag.Int("capture-keep", 20, "with -capture-dir, keep the files of the last `n` runs")
+var fallbackTerm = flag.Bool("fallback-term", false, "if acme is not running, write to the terminal and poll for changes")
+var confirm = flag.Bool("confirm", false, "wait for confirmation before each rerun")
+var showVersion = flag.Bool("version", false, "print the version of Watch and exit")
+var buffer = flag.Bool("buffer", false, "show each run's output all at once when the run ends")
+var wrap = flag.Int("wrap", 0, "break output lines longer than `n` characters")
+var hashContent = flag.Bool("hash", false, "ignore puts that leave a file's content unchanged")
+var hashMaxSize = flag.Int64("hash-max-size", 1<<20, "with -hash, always run for files larger than `bytes`")
+var group = flag.Duration("group", 0, "wait for changes to settle for `duration` and list the changed files before each run")
+var splitStreams = flag.Bool("split-streams", false, "show the command's standard error in a separate window")
+var shellCmd = flag.String("shell-cmd", "", "with -shell, run the command with `interpreter` -c instead of $SHELL")
+var resume = flag.Bool("resume", false, "start the last session again, with its directory, flags, and command")
+var notify = flag.String("notify", "", "run shell `command` after each run, without waiting for it, to send a notification")
+var lineBuffer = flag.Bool("line-buffer", true, "write output to the window a line at a time")
+var rootDir = flag.String("root", "", "take `dir` as acme's name for the current directory")
+var maxOutput = flag.Int64("max-output", 0, "show at most `bytes` of each run's output")
+var seq = flag.Bool("seq", false, "run each argument as a shell command, in order, stopping at the first failure")
+var cpuProfile = flag.String("cpuprofile", "", "write a CPU profile of Watch itself to `file`")
+var traceFile = flag.String("trace", "", "write an execution trace of Watch itself to `file`")
+var relative = flag.Bool("relative", false, "match -only and -ignore against file names relative to the current directory")
+var keepalive = flag.Bool("keepalive", false, "make Del refuse to delete the window while a command is running")
+var runUnique = flag.Bool("run-unique", false, "let a run go on when a change would rerun the same command line")
+var banner = flag.Bool("banner", true, "with -t, print a line with the time before each run")
+var firstFailure = flag.Bool("first-match-only", false, "with -seq, mark the command that failed and list those skipped")
+var extList = flag.String("ext", "", "only files with one of the comma-separated file `extensions`, such as go,c")
+var onError = flag.String("on-error", "", "run shell `command` after each failed run, with $WATCH_EXIT set to its exit status")
+var dirs stringList
+var files stringList
+var patterns stringList // -only, or .* if not given
+var ignores stringList
+
+// stringList is a flag.Value that collects repeated string flags.
+type stringList []string
+
+// onlyPatterns returns the -only patterns, or .* if none was given.
+func onlyPatterns() []string {
+	if len(patterns) == 0 {
+		return []string{".*"}
+	}
+	return patterns
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseFlags sets the flags from the config file and then from args,
+// which override it. A repeatable flag given in args replaces, rather
+// than adds to, the values from the file.
+func parseFlags(args []string) {
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	lists := []*stringList{&patterns, &ignores, &dirs, &files}
+	saved := make([]stringList, len(lists))
+	for i, l := range lists {
+		saved[i], *l = *l, nil
+	}
+	flag.CommandLine.Parse(args)
+	for i, l := range lists {
+		if *l == nil {
+			*l = saved[i]
+		}
+	}
+}
+
+// resetFlags returns every flag to its default value.
+func resetFlags() {
+	flag.VisitAll(func(f *flag.Flag) {
+		f.Value.Set(f.DefValue)
+	})
+	patterns, ignores, dirs, files = nil, nil, nil, nil
+}
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: Watch [-only pattern] cmd args...\n")
+	fmt.Fprintf(os.Stderr, "usage: Watch [-only pattern] [-ignore pattern] [-dir dir]... cmd args...\n")
 	os.Exit(2)
 }
 
 func main() {
+	flag.Var(&patterns, "only", "only files that match regular expression (may be repeated)")
+	flag.Var(&ignores, "ignore", "ignore files that match regular expression (may be repeated)")
+	flag.Var(&dirs, "dir", "watch files under directory (may be repeated)")
+	flag.Var(&files, "file", "watch only the named file (may be repeated)")
 	flag.Usage = usage
-	flag.Parse()
+	parseFlags(os.Args[1:])
+	if *showVersion {
+		printVersion()
+		return
+	}
+	if *resume {
+		if flag.NArg() > 0 {
+			usage()
+		}
+		st, err := loadState()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Chdir(st.Dir); err != nil {
+			log.Fatal(err)
+		}
+		// Start over from the session's own directory, so that its
+		// config file, not this one's, supplies the defaults.
+		resetFlags()
+		sessionArgs = st.Args
+		parseFlags(sessionArgs)
+	}
 	args = flag.Args()
-	if len(args) == 0 {
+	if *fromStdin {
+		if len(args) > 0 {
+			usage()
+		}
+		script, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		args = []string{"sh", "-c", string(script)}
+		if *shell {
+			args = []string{string(script)}
+		}
+	}
+	cmds := splitCommands(args)
+	if len(cmds) == 0 {
 		usage()
 	}
-	re := regexp.MustCompile(*pattern)
+	if len(cmds) > 1 {
+		if *triggerFIFO != "" {
+			// The copies would compete for each line.
+			log.Fatal("-trigger-fifo cannot be used with several commands")
+		}
+		status := spawn(sessionArgs[:len(sessionArgs)-len(args)], cmds)
+		saveState()
+		os.Exit(status)
+	}
+	args = cmds[0]
+	if *clearMode != "start" && *clearMode != "onsuccess" {
+		log.Fatalf("invalid -clear mode %q", *clearMode)
+	}
+	sig, err := signalNamed(*killSignal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	staleSignal = sig
+	if *highlight != "" {
+		highlightRE, err = regexp.Compile(*highlight)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *shellCmd != "" {
+		sh, err := exec.LookPath(*shellCmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*shellCmd = sh
+	}
+	if *envFile != "" {
+		extraEnv, err = readEnvFile(*envFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *follow && *noScroll {
+		log.Fatal("-follow and -no-scroll are mutually exclusive")
+	}
+	startProfiles()
 	pwd, _ := os.Getwd()
-	needrun <- nil
+	if *rootDir != "" {
+		localRoot, acmeRoot = pwd, filepath.Clean(*rootDir)
+	}
+	filt, err := newFilter(pwd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range filt.only {
+		onlyREs = append(onlyREs, p.re)
+	}
+	matchBase = filt.base
+	if *workDir != "" && !filepath.IsAbs(*workDir) {
+		*workDir = filepath.Join(pwd, *workDir)
+	}
+	if *eventsFile != "" {
+		if err := openStream(*eventsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *logFile != "" {
+		if err := openRunLog(*logFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelRuns = cancel
+	if *dryRun {
+		go handleSignals()
+		watchChanges(ctx, filt)
+		shutdown()
+	}
+	if *triggerFIFO != "" {
+		go readTriggers(ctx, *triggerFIFO)
+	}
+	if *watchSelf {
+		if name, err := commandPath(); err != nil {
+			log.Printf("-watch-self: %v", err)
+		} else {
+			go watchFile(ctx, name)
+		}
+	}
+	go debounce(ctx, *runOnStart || *once)
+	go handleSignals()
 
-	var err error
+	if !*term {
+		winTitle = *winName
+		if !filepath.IsAbs(winTitle) {
+			winTitle = acmeName(filt.roots[0]) + "/" + winTitle
+		}
+		if !*hideOnSuccess {
+			run.Lock()
+			err := openWindow()
+			if err == nil && *splitStreams {
+				err = openErrWindow()
+			}
+			run.Unlock()
+			if err != nil {
+				if !*fallbackTerm {
+					log.Fatal(err)
+				}
+				log.Printf("acme: %v; writing to the terminal instead", err)
+				*term = true
+			}
+		}
+	}
+	if *term && *confirm {
+		go readConfirmations()
+	}
+	display = windowOutput
 	if *term {
-		go termRunner()
-	} else {
-		win, err = acme.New()
-		if err != nil {
-			log.Fatal(err)
+		display = termOutput()
+	}
+	go runner(ctx)
+	if *once {
+		select {
+		case status := <-done:
+			stopProfiles()
+			os.Exit(status)
+		case <-ctx.Done():
 		}
-		win.Name(pwd + "/+watch")
-		win.Ctl("clean")
-		win.Fprintf("tag", "Get ")
-		go events()
-		go runner()
+	} else {
+		watchChanges(ctx, filt)
 	}
+	shutdown()
+}
 
+// watchChanges passes each file change to consider until ctx is done.
+func watchChanges(ctx context.Context, filt *filter) {
+	if *pollInterval > 0 {
+		poll(ctx, filt, *pollInterval)
+		return
+	}
+	if !*acmeLog {
+		<-ctx.Done()
+		return
+	}
 	l, err := acme.Log()
 	if err != nil {
-		log.Fatal(err)
+		if !*fallbackTerm {
+			log.Fatal(err)
+		}
+		log.Printf("acme log: %v; polling every %v instead", err, fallbackPoll)
+		poll(ctx, filt, fallbackPoll)
+		return
 	}
+	watchLog(ctx, filt, l)
+}
+
+// fallbackPoll is the -poll interval used when the acme log
+// is unavailable, with -fallback-term.
+const fallbackPoll = time.Second
+
+// watchLog reads the acme log from l, reconnecting with backoff when
+// the connection drops. It gives up after -log-retries consecutive
+// failures to reconnect. It closes the log and returns once ctx is done.
+func watchLog(ctx context.Context, filt *filter, l *acme.LogReader) {
+	failures := 0
+	delay := time.Second
 	for {
+		stop := context.AfterFunc(ctx, func() { l.Close() })
 		event, err := l.Read()
-		if err != nil {
-			log.Fatal(err)
+		for ; err == nil; event, err = l.Read() {
+			failures = 0
+			delay = time.Second
+			event.Name = localName(event.Name)
+			consider(ctx, filt, &event)
+		}
+		if !stop() {
+			return // closed by ctx
 		}
-		if event.Name != "" && event.Op == "put" && strings.HasPrefix(event.Name, pwd) && re.MatchString(event.Name) {
+		l.Close()
+		for {
+			if failures >= *logRetries {
+				log.Fatal(err)
+			}
+			failures++
+			log.Printf("acme log: %v; reconnecting in %v (attempt %d of %d)", err, delay, failures, *logRetries)
 			select {
-			case needrun <- &event:
-			default:
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			if delay *= 2; delay > 30*time.Second {
+				delay = 30 * time.Second
 			}
-			time.Sleep(100 * time.Millisecond)
+			if l, err = acme.Log(); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// consider requests a run for event if the filter accepts it,
+// unless ctx is done first.
+func consider(ctx context.Context, filt *filter, event *acme.LogEvent) {
+	why := filt.reject(event)
+	if *verbose {
+		if why == "" {
+			log.Printf("%s %s: triggers run", event.Op, event.Name)
+		} else {
+			log.Printf("%s %s: ignored: %s", event.Op, event.Name, why)
 		}
 	}
+	if *dryRun {
+		if why == "" {
+			fmt.Printf("%s %s: would run %s\n", event.Op, event.Name, strings.Join(expand(args, event, []string{event.Name}), " "))
+		} else {
+			fmt.Printf("%s %s: ignored: %s\n", event.Op, event.Name, why)
+		}
+		return
+	}
+	if why == "" {
+		select {
+		case changed <- event:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// changedFiles collects the files changed since the last run started,
+// for {...} and $WATCH_FILES.
+var changedFiles fileSet
+
+// A fileSet is a set of file names kept in the order they were added.
+type fileSet struct {
+	sync.Mutex
+	names []string
+	seen  map[string]bool
+}
+
+func (s *fileSet) add(name string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.seen[name] {
+		return
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	s.seen[name] = true
+	s.names = append(s.names, name)
+}
+
+// list returns the names the set holds, leaving it as it is.
+func (s *fileSet) list() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.names...)
+}
+
+// take empties the set, returning the names it held.
+func (s *fileSet) take() []string {
+	s.Lock()
+	defer s.Unlock()
+	names := s.names
+	s.names, s.seen = nil, nil
+	return names
 }
 
-func events() {
-	for e := range win.EventChan() {
-		switch e.C2 {
-		case 'x', 'X': // execute
-			if string(e.Text) == "Get" {
+// debounce owns needrun. It forwards the most recent request from
+// changed, whether a file event or a manual Get, once no further
+// request has arrived for the -debounce interval, or the longer -group
+// interval. File events arriving within -restart-delay of the end of
+// the last run are dropped, as are further events belonging to a save
+// already handled; requests from a -trigger-fifo are never dropped.
+// With -interval, a tick requests a run unless one is already pending.
+// With -confirm, requests other than those from rerun wait, collapsed
+// into one, for confirmation on confirmed. If initial is set, it first
+// requests a run immediately. Requests from rerun skip these checks
+// and the wait. It returns once ctx is done.
+func debounce(ctx context.Context, initial bool) {
+	var pending *acme.LogEvent
+	var timer <-chan time.Time
+	var startAt time.Time // no run before then, with -start-delay
+	if initial {
+		if *startDelay > 0 {
+			startAt = time.Now().Add(*startDelay)
+			timer = time.After(*startDelay)
+		} else {
+			needrun <- nil
+		}
+	}
+	recent := make(saves)
+	batch := make(map[string]bool) // targets of the pending events
+	var tick <-chan time.Time      // with -interval
+	var now bool                   // the pending request is from rerun
+	var held bool                  // a request awaits confirmation
+	var heldEvent *acme.LogEvent
+	settle := *debounceDelay
+	if *group > settle {
+		settle = *group
+	}
+	if *interval > 0 {
+		tick = time.Tick(*interval)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-changed:
+			if e != nil && e.Op == "fifo" {
+				changedFiles.add(e.Name)
+			} else if e != nil {
+				noteChange(e.Name)
+				if coolingDown() {
+					continue
+				}
+				target := saveTarget(e.Name)
+				if recent.repeat(target) {
+					continue
+				}
+				if *hashContent {
+					hashAccepted(e.Name)
+				}
+				batch[target] = true
+				changedFiles.add(target)
+			}
+			pending = e
+			timer = time.After(settle)
+		case <-tick:
+			if timer == nil {
+				timer = time.After(settle)
+			}
+		case e := <-rerun:
+			pending = e
+			timer = time.After(0)
+			now = true
+		case <-confirmed:
+			if held {
+				held = false
+				awaitConfirm(false)
 				select {
-				case needrun <- nil:
+				case needrun <- heldEvent:
 				default:
 				}
+			}
+		case <-timer:
+			if wait := time.Until(startAt); wait > 0 {
+				timer = time.After(wait)
 				continue
 			}
-			if string(e.Text) == "Del" {
-				win.Ctl("delete")
+			if *confirm && !now {
+				if !held {
+					awaitConfirm(true)
+				}
+				held, heldEvent = true, pending
+			} else {
+				select {
+				case needrun <- pending:
+				default:
+				}
 			}
+			now = false
+			for target := range batch {
+				recent.record(target)
+				delete(batch, target)
+			}
+			pending = nil
+			timer = nil
 		}
-		win.WriteEvent(e)
 	}
-	os.Exit(0)
+}
+
+// handleSignals waits for an exit signal, then kills the running
+// command, deletes the window, and exits.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, exitSignals...)
+	<-c
+	quit()
+}
+
+// staleSignal is the -kill-signal.
+var staleSignal os.Signal
+
+// graceKills holds the pending -kill-grace SIGKILLs, by command.
+var graceKills struct {
+	sync.Mutex
+	timers map[*exec.Cmd]*time.Timer
+}
+
+// end ends cmd, which Watch no longer needs, with -kill-signal,
+// following up after -kill-grace with SIGKILL unless it has exited.
+func end(cmd *exec.Cmd) {
+	signalGroup(cmd, staleSignal)
+	if *killGrace <= 0 || staleSignal == os.Kill {
+		return
+	}
+	graceKills.Lock()
+	defer graceKills.Unlock()
+	if graceKills.timers == nil {
+		graceKills.timers = make(map[*exec.Cmd]*time.Timer)
+	}
+	if graceKills.timers[cmd] != nil {
+		return
+	}
+	graceKills.timers[cmd] = time.AfterFunc(*killGrace, func() {
+		graceKills.Lock()
+		defer graceKills.Unlock()
+		if graceKills.timers[cmd] != nil {
+			delete(graceKills.timers, cmd)
+			kill(cmd)
+		}
+	})
+}
+
+// waited cancels any pending SIGKILL for cmd, once cmd.Wait returns:
+// its process group may be gone and its id reused.
+func waited(cmd *exec.Cmd) {
+	graceKills.Lock()
+	defer graceKills.Unlock()
+	if t := graceKills.timers[cmd]; t != nil {
+		t.Stop()
+		delete(graceKills.timers, cmd)
+	}
+}
+
+// quit cancels main's context, ending the running command and the
+// event loops, after which main calls shutdown.
+func quit() {
+	run.Lock()
+	cancelRuns() // under run, so that startCycle starts no more
+	run.Unlock()
+}
+
+// shutdown waits briefly for the running command to finish, deletes
+// the window, and exits.
+func shutdown() {
+	finished := make(chan bool)
+	go func() {
+		cycles.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(*killGrace + time.Second):
+		// Leave no command running behind Watch.
+		run.Lock()
+		if run.cmd != nil {
+			kill(run.cmd)
+		}
+		run.Unlock()
+	}
+	run.Lock()
+	closeWindow()
+	if errWin != nil {
+		errWin.Ctl("delete")
+	}
+	run.Unlock()
+	saveState()
+	stopProfiles()
+	os.Exit(exitStatus())
 }
 
 var run struct {
 	sync.Mutex
-	id int
+	id        int
+	cmd       *exec.Cmd       // running command, or nil
+	stopped   string          // why cmd was stopped from the tag, or ""
+	expired   bool            // cmd was killed by -timeout
+	mark      int             // offset in the body where the run's output begins
+	lines     int             // lines in the body, with -max-lines
+	marked    int             // lines before mark
+	status    int             // exit status of the last completed run
+	ended     time.Time       // when the last run finished
+	touched   map[string]bool // files changed while the run was in progress
+	hidden    bytes.Buffer    // output held while there is no window
+	state     string          // running, ok, or fail, for -title-status
+	last      *acme.LogEvent  // the last file change that triggered a run
+	capture   *os.File        // the run's -capture-dir file, or nil
+	awaiting  bool            // a run awaits confirmation, with -confirm
+	buffering bool            // output is held in hidden until the run ends
+	written   int64           // bytes of output shown, with -max-output
+	times     []time.Duration // durations of the completed runs, with -max-runs
+	line      string          // command line of the run in progress, or ""
+	restarts  int             // quick restarts in a row, with -restart-on-exit
+	held      *acme.LogEvent  // a change held by -run-unique until the run ends
+}
+
+// selfTrigger is how soon after a run a change to a file the run
+// touched is taken as a sign that the command triggers itself.
+const selfTrigger = 200 * time.Millisecond
+
+// noteChange records a change to the named file. A run in progress
+// remembers it; a change shortly after the run ended to a file that
+// also changed during the run draws a warning, since the command
+// probably writes a file it watches.
+func noteChange(name string) {
+	run.Lock()
+	defer run.Unlock()
+	if run.cmd != nil {
+		if run.touched == nil {
+			run.touched = make(map[string]bool)
+		}
+		run.touched[name] = true
+		return
+	}
+	if run.touched[name] && time.Since(run.ended) < selfTrigger {
+		log.Printf("possible self-trigger from %s", name)
+	}
+}
+
+// coolingDown reports whether the last run finished
+// less than -restart-delay ago.
+func coolingDown() bool {
+	run.Lock()
+	defer run.Unlock()
+	return !run.ended.IsZero() && time.Since(run.ended) < *restartDelay
+}
+
+// exitStatus returns the status Watch should exit with:
+// that of the last run with -propagate-exit, 0 otherwise.
+func exitStatus() int {
+	if !*propagate {
+		return 0
+	}
+	run.Lock()
+	defer run.Unlock()
+	return run.status
+}
+
+// stop ends the running command, if any, without starting another.
+// The run's summary line reports why.
+func stop(end func(*exec.Cmd), why string) {
+	run.Lock()
+	defer run.Unlock()
+	if run.cmd != nil {
+		end(run.cmd)
+		run.stopped = why
+	}
 }
 
 func envOf(event *acme.LogEvent) []string {
 	var filtered []string
 	for _, v := range os.Environ() {
-		vv := strings.Split(v, "=")
-		switch vv[0] {
-		case "samfile", "%", "winid":
+		key, _, _ := strings.Cut(v, "=")
+		switch {
+		case key == "samfile", key == "%", key == "winid", key == "WATCH_OP",
+			key == "WATCH_PATTERN", key == "WATCH_FILES", strings.HasPrefix(key, "WATCH_MATCH_"):
 			continue
 		default:
 			filtered = append(filtered, v)
 		}
 	}
+	// Later definitions override earlier ones, so the -env-file
+	// variables take precedence over inherited ones.
+	run.Lock()
+	filtered = append(filtered, extraEnv...)
+	run.Unlock()
+	filtered = append(filtered, "WATCH_PATTERN="+strings.Join(onlyPatterns(), "\n"))
 	if event == nil {
-		return filtered
+		return append(filtered, "WATCH_OP=manual")
+	}
+	for i, m := range submatches(event) {
+		filtered = append(filtered, fmt.Sprintf("WATCH_MATCH_%d=%s", i+1, m))
 	}
 	return append(
 		filtered,
 		"samfile="+event.Name,
 		"%="+event.Name,
-		fmt.Sprintf("winid=%d", event.ID))
+		fmt.Sprintf("winid=%d", event.ID),
+		"WATCH_OP="+event.Op)
 }
 
-func termRunner() {
-	var lastcmd *exec.Cmd
-	for event := range needrun {
-		if lastcmd != nil {
-			lastcmd.Process.Kill()
+// command returns the command running argv, wrapped in a shell if -shell is set.
+func command(ctx context.Context, argv []string) *exec.Cmd {
+	if *shell {
+		return shellCommand(ctx, strings.Join(argv, " "))
+	}
+	return prepare(exec.CommandContext(ctx, argv[0], argv[1:]...))
+}
+
+// expand returns args with each {} replaced by the name of the file
+// that triggered the run, or with -go-pkg by the directory of its Go
+// package. When there is no such file, an argument that is exactly {}
+// is dropped and {} elsewhere becomes empty. An argument that is exactly
+// {...} is replaced by the names in files, and {1}, {2}, and so on by
+// the text the groups of the -only pattern matched in the file's name.
+func expand(args []string, event *acme.LogEvent, files []string) []string {
+	subst, ok := "", event != nil
+	if ok {
+		subst = event.Name
+		if *goPkg {
+			subst, ok = goPackage(event.Name)
 		}
-		lastcmd = nil
-		cmd := exec.Command(args[0], args[1:]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = envOf(event)
-		if err := cmd.Start(); err != nil {
+	}
+	var pairs []string
+	if n := numSubexp(); n > 0 {
+		matches := submatches(event)
+		for i := 1; i <= n; i++ {
+			m := ""
+			if i <= len(matches) {
+				m = matches[i-1]
+			}
+			pairs = append(pairs, fmt.Sprintf("{%d}", i), m)
+		}
+	}
+	groups := strings.NewReplacer(pairs...)
+	var argv []string
+	for _, a := range args {
+		if a == "{...}" {
+			argv = append(argv, files...)
 			continue
 		}
-		lastcmd = cmd
-		go func() {
-			_ = cmd.Wait()
-		}()
+		if !ok && a == "{}" {
+			continue
+		}
+		argv = append(argv, groups.Replace(strings.ReplaceAll(a, "{}", subst)))
 	}
+	return argv
 }
 
-func runner() {
-	var lastcmd *exec.Cmd
-	for event := range needrun {
+// numSubexp returns the largest number of groups in an -only pattern.
+func numSubexp() int {
+	n := 0
+	for _, re := range onlyREs {
+		if re.NumSubexp() > n {
+			n = re.NumSubexp()
+		}
+	}
+	return n
+}
+
+// submatches returns the text of the groups of the first -only pattern
+// matching the name of the file event describes, or nil.
+func submatches(event *acme.LogEvent) []string {
+	if event == nil {
+		return nil
+	}
+	for _, re := range onlyREs {
+		if m := re.FindStringSubmatch(relativeTo(matchBase, event.Name)); m != nil {
+			return m[1:]
+		}
+	}
+	return nil
+}
+
+// goPackage returns the package directory holding the named Go file,
+// relative to the command's directory if it lies beneath it.
+// It reports false if name is not a Go file.
+func goPackage(name string) (string, bool) {
+	if !strings.HasSuffix(name, ".go") {
+		return "", false
+	}
+	dir := filepath.Dir(name)
+	cwd := *workDir
+	if cwd == "" {
+		cwd, _ = os.Getwd()
+	}
+	if cwd != "" {
+		rel, err := filepath.Rel(cwd, dir)
+		switch {
+		case err != nil, strings.HasPrefix(rel, ".."):
+		case rel == ".":
+			return ".", true
+		default:
+			return "./" + filepath.ToSlash(rel), true
+		}
+	}
+	return dir, true
+}
+
+// commandPath returns the absolute path of the program args[0] names,
+// found as the command would be, for -watch-self.
+func commandPath() (string, error) {
+	name := args[0]
+	if *workDir != "" && strings.Contains(name, "/") && !filepath.IsAbs(name) {
+		name = filepath.Join(*workDir, name)
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
+
+// shellCommand returns a command running line with the -shell-cmd
+// interpreter, or $SHELL, or /bin/sh, given -c.
+func shellCommand(ctx context.Context, line string) *exec.Cmd {
+	sh := *shellCmd
+	if sh == "" {
+		sh = os.Getenv("SHELL")
+	}
+	if sh == "" {
+		sh = "/bin/sh"
+	}
+	return prepare(exec.CommandContext(ctx, sh, "-c", line))
+}
+
+// prepare arranges for cmd to run in the -cwd directory and in its own
+// process group, so that signals reach its children, and to be ended
+// when its context is done. Its standard input is the null device,
+// or with -stdin-tty Watch's own; the command then stays in Watch's
+// process group, since a background group reading the terminal
+// would be stopped.
+func prepare(cmd *exec.Cmd) *exec.Cmd {
+	cmd.Dir = *workDir
+	cmd.Stdin = nil // os/exec connects a nil Stdin to os.DevNull
+	if *stdinTTY {
+		cmd.Stdin = os.Stdin
+	} else {
+		setpgid(cmd)
+	}
+	cmd.Cancel = func() error {
+		end(cmd)
+		return nil
+	}
+	return cmd
+}
+
+// deadline returns a child of ctx that expires after -timeout, if set.
+func deadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *timeout > 0 {
+		return context.WithTimeout(ctx, *timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// summary describes how a finished command exited and how long it ran,
+// as in "exit 1, 0.4s" or "signal: killed, 2.0s".
+func summary(cmd *exec.Cmd, d time.Duration) string {
+	ps := cmd.ProcessState
+	how := ps.String()
+	if code := ps.ExitCode(); code >= 0 {
+		how = fmt.Sprintf("exit %d", code)
+	}
+	return fmt.Sprintf("%s, %.1fs", how, d.Seconds())
+}
+
+// exitCode returns the exit status corresponding to the result of
+// running a command: its own exit code, or 1 if it did not exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() >= 0 {
+		return e.ExitCode()
+	}
+	return 1
+}
+
+// bell rings the controlling terminal's bell,
+// falling back to the window tag if there is no terminal.
+func bell() {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		if win != nil {
+			win.Write("tag", []byte("\a"))
+		}
+		return
+	}
+	tty.Write([]byte("\a"))
+	tty.Close()
+}
+
+// An output is where runs are shown: the acme window, or the terminal
+// with -t. Its functions are called with run locked, and write and
+// writeErr only for the current run.
+type output struct {
+	begin    func(id int)   // prepares to show run id
+	write    func(p []byte) // shows the command's output
+	writeErr func(p []byte) // shows the command's standard error
+	note     func(p []byte) // shows Watch's own lines, such as "$ cmd"
+	end      func()         // follows the end of each command
+}
+
+// display is the output in use, set before the first run.
+var display output
+
+// termOutput returns the output for the terminal, with -t. The
+// command's standard output goes to Watch's, and its standard error
+// and Watch's notes to Watch's standard error, prefixed by -label.
+func termOutput() output {
+	stdout := &prefixer{w: os.Stdout, prefix: *label}
+	stderr := &prefixer{w: os.Stderr, prefix: *label}
+	return output{
+		begin:    beginTerm,
+		write:    func(p []byte) { stdout.Write(p) },
+		writeErr: func(p []byte) { stderr.Write(p) },
+		note:     func(p []byte) { stderr.Write(p) },
+		end:      func() {},
+	}
+}
+
+// runner starts a run, shown on the display, for each request on
+// needrun, ending the run in progress, until ctx is done.
+func runner(ctx context.Context) {
+	for {
+		var event *acme.LogEvent
+		select {
+		case <-ctx.Done():
+			return
+		case event = <-needrun:
+		}
+		line := strings.Join(expand(args, event, changedFiles.list()), " ")
+		if unique(event, line) {
+			continue
+		}
+		files := changedFiles.take()
+		id := newRun(line)
 		run.Lock()
-		run.id++
-		id := run.id
+		if event != nil {
+			moved := run.last == nil || event.Name != run.last.Name
+			run.last = event
+			if moved {
+				showTag()
+			}
+		}
+		setState("running")
+		display.begin(id)
 		run.Unlock()
-		if lastcmd != nil {
-			lastcmd.Process.Kill()
+		startCycle(ctx, id, event, files)
+	}
+}
+
+// beginTerm prints the -banner before run id.
+func beginTerm(id int) {
+	if *banner {
+		fmt.Printf("%s--- %s\n", *label, time.Now().Format("15:04:05"))
+	}
+}
+
+// awaitConfirm shows, or with waiting false stops showing,
+// that a run awaits confirmation, with -confirm.
+func awaitConfirm(waiting bool) {
+	run.Lock()
+	defer run.Unlock()
+	run.awaiting = waiting
+	if *term && waiting {
+		fmt.Fprintf(os.Stderr, "Watch: changes pending; press Enter to run\n")
+	}
+	showTag()
+}
+
+// readConfirmations confirms a run for each line typed on standard
+// input, with -confirm and -t.
+func readConfirmations() {
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		confirmed <- true
+	}
+}
+
+// reload rereads the -env-file, if any, reporting whether it succeeded.
+func reload() bool {
+	if *envFile == "" {
+		return true
+	}
+	env, err := readEnvFile(*envFile)
+	run.Lock()
+	defer run.Unlock()
+	if err != nil {
+		bodyPrintf("%v\n", err)
+		return false
+	}
+	extraEnv = env
+	return true
+}
+
+// unique reports whether, with -run-unique, the file change event
+// would rerun the command line of the run in progress, and so should
+// leave that run alone. The change is then held, to run once more
+// when the run ends.
+func unique(event *acme.LogEvent, line string) bool {
+	if !*runUnique || event == nil {
+		return false
+	}
+	run.Lock()
+	defer run.Unlock()
+	if run.line != line {
+		return false
+	}
+	if *verbose {
+		log.Printf("%s %s: same command still running; rerun when it ends", event.Op, event.Name)
+	}
+	run.held = event
+	return true
+}
+
+// newRun ends the running command, if any, and starts
+// bookkeeping for a new run of command line line, returning its id.
+func newRun(line string) int {
+	run.Lock()
+	defer run.Unlock()
+	run.id++
+	if run.cmd != nil {
+		end(run.cmd)
+	}
+	run.cmd = nil
+	run.stopped = ""
+	run.expired = false
+	run.mark = 0
+	run.touched = nil
+	run.capture = nil
+	run.written = 0
+	run.line = line
+	run.held = nil
+	return run.id
+}
+
+// startCycle carries out run id in the background, tracked by cycles,
+// and quits once -max-runs runs are done. It starts nothing once ctx
+// is done.
+func startCycle(ctx context.Context, id int, event *acme.LogEvent, files []string) {
+	run.Lock()
+	defer run.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	cycles.Add(1)
+	go func() {
+		last := cycle(ctx, id, event, files)
+		cycles.Done()
+		if last {
+			quit()
 		}
-		lastcmd = nil
-		cmd := exec.Command(args[0], args[1:]...)
-		r, w, err := os.Pipe()
-		if err != nil {
-			log.Fatal(err)
+	}()
+}
+
+// cycle carries out run id, triggered by event after the given files
+// changed: the -pre hook, the command if the hook succeeds, the
+// -on-error hook if either fails, and then the -post hook.
+// It reports whether -max-runs runs are done.
+func cycle(ctx context.Context, id int, event *acme.LogEvent, files []string) bool {
+	env := append(envOf(event), "WATCH_FILES="+strings.Join(files, "\n"))
+	if *group > 0 && len(files) > 0 {
+		note(id, "# changed: "+strings.Join(files, ", ")+"\n")
+	}
+	if capture := openCapture(); capture != nil {
+		defer capture.Close()
+		run.Lock()
+		if id == run.id {
+			run.capture = capture
 		}
-		win.Addr(",")
-		win.Write("data", nil)
-		win.Ctl("clean")
-		win.Fprintf("body", "$ %s\n", strings.Join(args, " "))
-		cmd.Stdout = w
-		cmd.Stderr = w
-		cmd.Env = envOf(event)
-		if err := cmd.Start(); err != nil {
-			r.Close()
-			w.Close()
-			win.Fprintf("body", "%s: %s\n", strings.Join(args, " "), err)
-			continue
+		run.Unlock()
+	}
+	began := time.Now()
+	ok, err := true, error(nil)
+	exited := false // the command exited on its own
+	line := *pre    // what ran, for -log: the command, or -pre if it failed
+	if *pre != "" {
+		ok, err = execute(ctx, id, *pre, hook(*pre), env)
+	}
+	start := time.Now() // when the command started, or the run if -pre failed
+	if !ok || err != nil {
+		start = began
+	} else {
+		steps := [][]string{expand(args, event, files)}
+		if *seq {
+			steps = nil
+			for _, a := range args {
+				steps = append(steps, expand([]string{a}, event, files))
+			}
 		}
-		lastcmd = cmd
-		w.Close()
-		go func() {
-			buf := make([]byte, 4096)
-			for {
-				n, err := r.Read(buf)
-				if err != nil {
-					break
+		var lines []string
+		for i, argv := range steps {
+			if len(argv) == 0 {
+				continue
+			}
+			argv, line := argv, strings.Join(argv, " ")
+			mk := func(ctx context.Context) *exec.Cmd {
+				if *seq {
+					return shellCommand(ctx, line)
 				}
-				run.Lock()
-				if id == run.id {
-					win.Write("body", buf[:n])
+				return command(ctx, argv)
+			}
+			lines = append(lines, line)
+			ok, err = execute(ctx, id, line, mk, env)
+			if ok && err != nil && *seq && *firstFailure {
+				markFailure(id, line, steps[i+1:])
+			}
+			if !ok || err != nil {
+				break
+			}
+		}
+		line = strings.Join(lines, "; ")
+		run.Lock()
+		// A command that could not be started did not exit on its own;
+		// restarting it would only fail again.
+		_, isExit := err.(*exec.ExitError)
+		exited = ok && id == run.id && !run.expired && (err == nil || isExit)
+		run.Unlock()
+	}
+	// A failed -pre hook fails the run as the command would have.
+	if ok {
+		logRun(event, line, start, err)
+		run.Lock()
+		if id == run.id {
+			run.times = append(run.times, time.Since(start))
+			if err == nil && run.mark > 0 && win != nil {
+				win.Addr("#0,#%d", run.mark)
+				win.Write("data", nil)
+				win.Ctl("clean")
+				run.lines -= run.marked
+			}
+			// Once Watch is quitting, a killed run must not reopen the window.
+			if *hideOnSuccess && !*term && ctx.Err() == nil {
+				if err == nil {
+					closeWindow()
+				} else if win == nil {
+					showWindow()
 				}
-				run.Unlock()
 			}
-			if err := cmd.Wait(); err != nil {
-				run.Lock()
-				if id == run.id {
-					win.Fprintf("body", "%s: %s\n", strings.Join(args, " "), err)
+			if err != nil && *ring {
+				bell()
+			}
+		}
+		run.Unlock()
+		if err != nil && *onError != "" {
+			execute(ctx, id, *onError, hook(*onError), append(env, fmt.Sprintf("WATCH_EXIT=%d", exitCode(err))))
+		}
+		if *post != "" {
+			status := "ok"
+			if err != nil {
+				status = "fail"
+			}
+			execute(ctx, id, *post, hook(*post), append(env, "WATCH_STATUS="+status))
+		}
+	}
+	run.Lock()
+	var times []time.Duration // set when -max-runs is reached
+	var held *acme.LogEvent   // the change to rerun for, with -run-unique
+	if id == run.id {
+		held, run.held = run.held, nil
+		if run.buffering {
+			flushBuffer()
+		}
+		run.status = exitCode(err)
+		run.ended = time.Now()
+		run.line = ""
+		if err == nil {
+			setState("ok")
+		} else {
+			setState("fail")
+		}
+		if *notify != "" {
+			notifyDone(event, env, err, time.Since(began))
+		}
+		if *maxRuns > 0 && len(run.times) >= *maxRuns {
+			times = run.times
+		}
+	}
+	run.Unlock()
+	if held != nil && ctx.Err() == nil {
+		go func() {
+			select {
+			case rerun <- held:
+			case <-ctx.Done():
+			}
+		}()
+	} else if exited && *restartOnExit && !*once {
+		time.AfterFunc(restartBackoff(time.Since(start)), func() {
+			run.Lock()
+			current := id == run.id
+			run.Unlock()
+			if current {
+				select {
+				case rerun <- event:
+				case <-ctx.Done():
 				}
-				run.Unlock()
 			}
-			win.Fprintf("body", "$\n")
-			win.Fprintf("addr", "#0")
-			win.Ctl("dot=addr")
-			win.Ctl("show")
-			win.Ctl("clean")
+		})
+	}
+	if *once {
+		done <- exitCode(err)
+	}
+	if times != nil {
+		for i, d := range times {
+			fmt.Fprintf(os.Stderr, "run %d: %.1fs\n", i+1, d.Seconds())
+		}
+		return true
+	}
+	return false
+}
+
+// markFailure notes, with -first-match-only, that the command line
+// of run id failed and that the steps after it were skipped.
+func markFailure(id int, line string, skipped [][]string) {
+	text := "# failed: " + line + "\n"
+	for _, argv := range skipped {
+		if len(argv) > 0 {
+			text += "# skipped: " + strings.Join(argv, " ") + "\n"
+		}
+	}
+	note(id, text)
+}
+
+// Restarts with -restart-on-exit wait at least minRestart, doubling
+// up to maxRestart while the command keeps exiting within stableRun.
+const (
+	minRestart = 100 * time.Millisecond
+	maxRestart = 30 * time.Second
+	stableRun  = 10 * time.Second
+)
+
+// restartBackoff returns how long to wait before restarting, with
+// -restart-on-exit, a command that exited after running for ran.
+// A command that keeps exiting soon after it starts is restarted less
+// and less often, so that a crashing command does not flood the window.
+func restartBackoff(ran time.Duration) time.Duration {
+	run.Lock()
+	defer run.Unlock()
+	if ran >= stableRun {
+		run.restarts = 0
+	}
+	d := *restartDelay
+	if d < minRestart {
+		d = minRestart
+	}
+	limit := maxRestart
+	if *restartDelay > limit {
+		limit = *restartDelay
+	}
+	for i := 0; i < run.restarts && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	run.restarts++
+	return d
+}
+
+// note shows text before the output of run id, if it is current.
+func note(id int, text string) {
+	run.Lock()
+	defer run.Unlock()
+	if id == run.id {
+		display.write([]byte(text))
+	}
+}
+
+// notifyDone starts the -notify command for a run that took d and
+// ended with err, without waiting for it.
+func notifyDone(event *acme.LogEvent, env []string, err error, d time.Duration) {
+	status, file := "ok", ""
+	if err != nil {
+		status = "fail"
+	}
+	if event != nil {
+		file = event.Name
+	}
+	cmd := shellCommand(context.Background(), *notify)
+	cmd.Env = append(env,
+		"WATCH_STATUS="+status,
+		fmt.Sprintf("WATCH_DURATION=%.1f", d.Seconds()),
+		"WATCH_FILE="+file)
+	if err := cmd.Start(); err != nil {
+		log.Printf("-notify: %v", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+// drainGrace is how long Watch waits, after a command exits, for the
+// rest of its output.
+const drainGrace = time.Second
+
+// drain copies the output of run id from r to out, in whole lines
+// unless -line-buffer=false, and to capture if it is not nil.
+// A -label needs whole lines to prefix, so it keeps them whole regardless.
+func drain(id int, out io.Writer, r io.Reader, capture *os.File) {
+	out = teeEvents(out, id)
+	if *lineBuffer || *label != "" {
+		lines := &lineWriter{w: out}
+		defer lines.Flush()
+		out = lines
+	}
+	if capture != nil {
+		r = io.TeeReader(r, capture)
+	}
+	io.Copy(out, r)
+}
+
+// hook returns a function making the command for a -pre or -post hook.
+func hook(line string) func(context.Context) *exec.Cmd {
+	return func(ctx context.Context) *exec.Cmd {
+		return shellCommand(ctx, line)
+	}
+}
+
+// execute runs one command of run id, copying its output to the
+// display. It returns the command's result and whether the run should
+// go on: false if the run has been superseded or stopped.
+func execute(ctx context.Context, id int, name string, mk func(context.Context) *exec.Cmd, env []string) (bool, error) {
+	ctx, cancel := deadline(ctx)
+	defer cancel()
+	cmd := mk(ctx)
+	cmd.Env = env
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	var er, ew *os.File // stderr, with -split-streams or -t
+	if *splitStreams || *term {
+		er, ew, err = os.Pipe()
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmd.Stderr = ew
+		defer er.Close()
+	}
+	run.Lock()
+	if id != run.id {
+		run.Unlock()
+		w.Close()
+		if ew != nil {
+			ew.Close()
+		}
+		return false, nil
+	}
+	if !*quiet {
+		notef("$ %s\n", name)
+	}
+	capture := run.capture
+	if capture != nil {
+		fmt.Fprintf(capture, "$ %s\n", name)
+	}
+	start := time.Now()
+	err = cmd.Start()
+	w.Close()
+	if ew != nil {
+		ew.Close()
+	}
+	if err != nil {
+		notef("%s: %s\n", name, err)
+		display.end()
+		run.Unlock()
+		if *term && id == 1 && (errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist)) {
+			// A missing command on the first run is a mistake
+			// in the command line; watching on would hide it.
+			os.Exit(1)
+		}
+		return true, err
+	}
+	run.cmd = cmd
+	run.Unlock()
+	emitStart(id, name)
+	out := newChain(id, false)
+	var errOut *chain // with -split-streams or -t
+	errDone := make(chan bool)
+	if er != nil {
+		errOut = newChain(id, true)
+		go func() {
+			drain(id, errOut, er, capture)
+			close(errDone)
 		}()
+	} else {
+		close(errDone)
+	}
+	outDone := make(chan bool)
+	go func() {
+		drain(id, out, r, capture)
+		close(outDone)
+	}()
+	err = cmd.Wait()
+	waited(cmd)
+	// Output may still be in the pipes, or a process the command left
+	// running may hold them open. Wait a little for the drains to end,
+	// then close the pipes to end them.
+	grace := time.After(drainGrace)
+	for _, d := range []chan bool{outDone, errDone} {
+		select {
+		case <-d:
+		case <-grace:
+			r.Close()
+			if er != nil {
+				er.Close()
+			}
+			<-d
+		}
+	}
+	out.body.Flush()
+	if errOut != nil {
+		errOut.body.Flush()
+	}
+	emitEnd(id, name, err, time.Since(start))
+	status := summary(cmd, time.Since(start))
+	run.Lock()
+	defer run.Unlock()
+	if id != run.id {
+		return false, err
+	}
+	run.cmd = nil
+	if out.tail != nil && err != nil && run.stopped == "" {
+		showTail(out.tail, display.write)
+		if errOut != nil {
+			showTail(errOut.tail, display.writeErr)
+		}
+	}
+	ok := true
+	if run.stopped != "" {
+		status = run.stopped
+		ok = false
+	} else if ctx.Err() == context.DeadlineExceeded {
+		status = fmt.Sprintf("timed out after %v", *timeout)
+		run.expired = true
+	} else if _, isExit := err.(*exec.ExitError); err != nil && !isExit {
+		notef("%s: %s\n", name, err)
+	}
+	notef("$ (%s)\n", status)
+	if capture != nil {
+		fmt.Fprintf(capture, "$ (%s)\n", status)
 	}
+	display.end()
+	return ok, err
+}
+
+// A chain is the writer through which the output of a run, or its
+// standard error, reaches the display: with ANSI sequences stripped,
+// lines highlighted and wrapped, and then held back by -summary-only
+// or capped by -max-output.
+type chain struct {
+	io.Writer
+	body *bodyWriter
+	tail *tailWriter // with -summary-only
+}
+
+// newChain returns the chain for the output of run id,
+// or its standard error if stderr is set.
+func newChain(id int, stderr bool) *chain {
+	c := &chain{body: &bodyWriter{id: id, stderr: stderr}}
+	c.Writer = c.body
+	if *maxOutput > 0 {
+		c.Writer = &capWriter{id: id, w: c.Writer}
+	}
+	if *summaryOnly {
+		c.tail = &tailWriter{n: *tailLines}
+		c.Writer = c.tail
+	}
+	if *wrap > 0 {
+		c.Writer = &wrapper{w: c.Writer, width: *wrap}
+	}
+	if highlightRE != nil {
+		c.Writer = &highlighter{w: c.Writer}
+	}
+	if *stripANSI {
+		c.Writer = &ansiStripper{w: c.Writer}
+	}
+	return c
+}
+
+// showTail shows the lines tail kept of a failed run with show,
+// with -summary-only.
+func showTail(tail *tailWriter, show func([]byte)) {
+	if tail.dropped > 0 {
+		show([]byte(fmt.Sprintf("... (%d lines omitted)\n", tail.dropped)))
+	}
+	show(tail.Bytes())
+}
+
+// notef shows one of Watch's own lines on the display.
+func notef(format string, args ...interface{}) {
+	display.note([]byte(fmt.Sprintf(format, args...)))
 }
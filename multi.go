@@ -0,0 +1,81 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+)
+
+// splitCommands splits args into commands separated by "--".
+func splitCommands(args []string) [][]string {
+	var cmds [][]string
+	start := 0
+	for i, a := range args {
+		if a == "--" {
+			if i > start {
+				cmds = append(cmds, args[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(args) {
+		cmds = append(cmds, args[start:])
+	}
+	return cmds
+}
+
+// spawn runs a copy of Watch for each of cmds, with the same flags
+// but its own window, named with the -name suffix followed by .1, .2,
+// and so on. All of them watch the same files, so each change reruns
+// every command. spawn waits for the copies to exit, passing on any
+// exit signal, and returns the highest of their exit statuses.
+func spawn(flags []string, cmds [][]string) int {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// flag.Parse consumes a -- ending the flags.
+	if n := len(flags); n > 0 && flags[n-1] == "--" {
+		flags = flags[:n-1]
+	}
+	var children []*exec.Cmd
+	for i, c := range cmds {
+		argv := append([]string(nil), flags...)
+		argv = append(argv, "-name", fmt.Sprintf("%s.%d", *winName, i+1), "--")
+		argv = append(argv, c...)
+		child := exec.Command(self, argv...)
+		child.Stdin = os.Stdin
+		child.Stdout = os.Stdout
+		child.Stderr = os.Stderr
+		if err := child.Start(); err != nil {
+			log.Fatal(err)
+		}
+		children = append(children, child)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, exitSignals...)
+	go func() {
+		for sig := range sigs {
+			for _, child := range children {
+				child.Process.Signal(sig)
+			}
+		}
+	}()
+
+	status := 0
+	for _, child := range children {
+		if err := child.Wait(); err != nil {
+			if code := exitCode(err); code > status {
+				status = code
+			}
+		}
+	}
+	return status
+}
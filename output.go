@@ -0,0 +1,342 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxBatch is the most output a bodyWriter holds before flushing.
+const maxBatch = 64 << 10
+
+// A bodyWriter copies the output of run id to the display, or its
+// standard error if stderr is set, dropping it once the run has been
+// superseded. With -flush, it batches writes made within the flush
+// interval into one.
+type bodyWriter struct {
+	id     int
+	stderr bool
+	mu     sync.Mutex
+	buf    []byte
+	timer  *time.Timer
+}
+
+func (w *bodyWriter) Write(p []byte) (int, error) {
+	if *flushDelay <= 0 {
+		w.show(p)
+		return len(p), nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= maxBatch {
+		w.flush()
+	} else if w.timer == nil {
+		w.timer = time.AfterFunc(*flushDelay, w.Flush)
+	}
+	return len(p), nil
+}
+
+// Flush writes any batched output to the display.
+func (w *bodyWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flush()
+}
+
+func (w *bodyWriter) flush() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.buf) > 0 {
+		w.show(w.buf)
+		w.buf = w.buf[:0]
+	}
+}
+
+// show shows p on the display if run id is current.
+func (w *bodyWriter) show(p []byte) {
+	run.Lock()
+	defer run.Unlock()
+	if w.id != run.id {
+		return
+	}
+	if w.stderr {
+		display.writeErr(p)
+	} else {
+		display.write(p)
+	}
+}
+
+// A capWriter copies the output of run id to w until the run has
+// written -max-output bytes, then notes the truncation and discards
+// the rest. Its count is shared by all the writers of the run.
+type capWriter struct {
+	id int
+	w  io.Writer
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	run.Lock()
+	if c.id != run.id || run.written >= *maxOutput {
+		run.Unlock()
+		return n, nil
+	}
+	full := false
+	if room := *maxOutput - run.written; int64(len(p)) >= room {
+		i := int(room)
+		for i > 0 && i < len(p) && !utf8.RuneStart(p[i]) {
+			i--
+		}
+		p = p[:i]
+		run.written = *maxOutput
+		full = true
+	} else {
+		run.written += int64(len(p))
+	}
+	run.Unlock()
+	if _, err := c.w.Write(p); err != nil {
+		return 0, err
+	}
+	if full {
+		fmt.Fprintf(c.w, "\n[output truncated after %d bytes]\n", *maxOutput)
+	}
+	return n, nil
+}
+
+// A tailWriter keeps the last n lines written to it, with -summary-only.
+type tailWriter struct {
+	n       int
+	lines   [][]byte
+	partial []byte // the unterminated last line
+	dropped int    // lines no longer kept
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.lines = append(w.lines, append([]byte(nil), w.partial[:i+1]...))
+		w.partial = w.partial[i+1:]
+		if len(w.lines) > w.n {
+			w.lines = w.lines[1:]
+			w.dropped++
+		}
+	}
+	return len(p), nil
+}
+
+// Bytes returns the lines kept.
+func (w *tailWriter) Bytes() []byte {
+	return append(bytes.Join(w.lines, nil), w.partial...)
+}
+
+// A lineWriter copies text to w in whole lines, so that the writers
+// after it see each line in one piece. It holds an unterminated last
+// line until the line ends, Flush is called, or maxBatch bytes are
+// held; even then it splits no UTF-8 sequence.
+type lineWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	n := bytes.LastIndexByte(l.buf, '\n') + 1
+	if n == 0 && len(l.buf) >= maxBatch {
+		n = len(l.buf)
+		r := n - 1
+		for r > 0 && r > n-utf8.UTFMax && !utf8.RuneStart(l.buf[r]) {
+			r--
+		}
+		if !utf8.FullRune(l.buf[r:]) {
+			n = r
+		}
+	}
+	if n == 0 {
+		return len(p), nil
+	}
+	_, err := l.w.Write(l.buf[:n])
+	l.buf = append(l.buf[:0], l.buf[n:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes any text held.
+func (l *lineWriter) Flush() {
+	if len(l.buf) > 0 {
+		l.w.Write(l.buf)
+		l.buf = l.buf[:0]
+	}
+}
+
+// A prefixer copies text to w with prefix at the start of each line.
+// It expects whole lines, as from a lineWriter.
+type prefixer struct {
+	w      io.Writer
+	prefix string
+}
+
+func (p *prefixer) Write(b []byte) (int, error) {
+	var out []byte
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) > 0 {
+			out = append(append(out, p.prefix...), line...)
+		}
+	}
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// A wrapper copies text to w, breaking lines longer than width runes.
+// A line may span writes. Given whole runes, as from a lineWriter,
+// it splits none.
+type wrapper struct {
+	w     io.Writer
+	width int
+	col   int // runes in the current line
+}
+
+func (wr *wrapper) Write(p []byte) (int, error) {
+	n := len(p)
+	var out []byte
+	for len(p) > 0 {
+		r, size := utf8.DecodeRune(p)
+		if r == '\n' {
+			wr.col = 0
+		} else {
+			if wr.col == wr.width {
+				out = append(out, '\n')
+				wr.col = 0
+			}
+			wr.col++
+		}
+		out = append(out, p[:size]...)
+		p = p[size:]
+	}
+	if _, err := wr.w.Write(out); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// A highlighter copies text to w, prefixing the lines that match
+// -highlight with -marker. It expects whole lines, as from a lineWriter.
+type highlighter struct {
+	w io.Writer
+}
+
+func (h *highlighter) Write(p []byte) (int, error) {
+	if _, err := h.w.Write(h.mark(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// mark returns text with the matching lines prefixed.
+func (h *highlighter) mark(text []byte) []byte {
+	var out []byte
+	for _, line := range bytes.SplitAfter(text, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if highlightRE.Match(bytes.TrimSuffix(line, []byte("\n"))) {
+			out = append(out, *marker...)
+		}
+		out = append(out, line...)
+	}
+	return out
+}
+
+// An ansiStripper copies text to w with ANSI escape sequences removed:
+// CSI sequences such as colors and cursor motion, OSC sequences,
+// and other escapes, such as ESC ( B, made of intermediate bytes and a
+// final byte. Sequences may span writes.
+type ansiStripper struct {
+	w     io.Writer
+	state int
+}
+
+const (
+	ansiText   = iota
+	ansiEsc    // after ESC
+	ansiCSI    // after ESC [
+	ansiOSC    // after ESC ]
+	ansiOSCEsc // after ESC within an OSC sequence
+	ansiNF     // after ESC and intermediate bytes, as in ESC (
+)
+
+// escape advances an escape sequence other than CSI or OSC past c:
+// intermediate bytes in 0x20-0x2f continue it, and any other byte,
+// normally a final byte in 0x30-0x7e, ends it.
+func (s *ansiStripper) escape(c byte) {
+	if c >= 0x20 && c <= 0x2f {
+		s.state = ansiNF
+	} else {
+		s.state = ansiText
+	}
+}
+
+func (s *ansiStripper) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, c := range p {
+		switch s.state {
+		case ansiText:
+			if c == 0x1b {
+				s.state = ansiEsc
+			} else {
+				out = append(out, c)
+			}
+		case ansiEsc:
+			switch c {
+			case '[':
+				s.state = ansiCSI
+			case ']':
+				s.state = ansiOSC
+			default:
+				s.escape(c)
+			}
+		case ansiNF:
+			s.escape(c)
+		case ansiCSI:
+			// Parameter and intermediate bytes continue the
+			// sequence; a final byte in 0x40-0x7e ends it.
+			if c >= 0x40 && c <= 0x7e {
+				s.state = ansiText
+			}
+		case ansiOSC:
+			switch c {
+			case '\a':
+				s.state = ansiText
+			case 0x1b:
+				s.state = ansiOSCEsc
+			}
+		case ansiOSCEsc:
+			if c == '\\' {
+				s.state = ansiText
+			} else {
+				s.state = ansiOSC
+			}
+		}
+	}
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"9fans.net/go/acme"
+)
+
+// poll watches for changes by walking the filter's watched directories
+// and files every interval, in place of the acme log. A file that
+// appears, whose modification time changes, or that is replaced by
+// another file under the same name is reported as a put; one that
+// disappears is reported as a del. It returns once ctx is done.
+func poll(ctx context.Context, filt *filter, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	old := snapshot(filt)
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		cur := snapshot(filt)
+		for name, info := range cur {
+			if o, ok := old[name]; !ok || !o.ModTime().Equal(info.ModTime()) || !os.SameFile(o, info) {
+				consider(ctx, filt, &acme.LogEvent{Op: "put", Name: name})
+			}
+		}
+		for name := range old {
+			if _, ok := cur[name]; !ok {
+				consider(ctx, filt, &acme.LogEvent{Op: "del", Name: name})
+			}
+		}
+		old = cur
+	}
+}
+
+// snapshot returns the file info of the files the filter watches.
+func snapshot(filt *filter) map[string]fs.FileInfo {
+	infos := make(map[string]fs.FileInfo)
+	roots := filt.roots
+	if len(filt.files) > 0 {
+		roots = nil
+		for name := range filt.files {
+			roots = append(roots, name)
+		}
+	}
+	for _, root := range roots {
+		filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := os.Stat(name); err == nil {
+				infos[name] = info
+			}
+			return nil
+		})
+	}
+	return infos
+}
+
+// selfPoll is how often watchFile checks its file.
+const selfPoll = time.Second
+
+// watchFile requests a run each time the named file's modification
+// time changes, until ctx is done. The file need not be under a
+// watched directory.
+func watchFile(ctx context.Context, name string) {
+	t := time.NewTicker(selfPoll)
+	defer t.Stop()
+	var old time.Time
+	if info, err := os.Stat(name); err == nil {
+		old = info.ModTime()
+	}
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		info, err := os.Stat(name)
+		if err != nil || info.ModTime().Equal(old) {
+			continue
+		}
+		old = info.ModTime()
+		select {
+		case changed <- &acme.LogEvent{Op: "put", Name: name}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var exitSignals = []os.Signal{os.Interrupt}
+
+func signalNamed(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "INT":
+		return os.Interrupt, nil
+	case "KILL":
+		return os.Kill, nil
+	}
+	return nil, fmt.Errorf("unknown signal %q", name)
+}
+
+func setpgid(cmd *exec.Cmd) {}
+
+func kill(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+func terminate(cmd *exec.Cmd) {
+	signalGroup(cmd, os.Interrupt)
+}
+
+func signalGroup(cmd *exec.Cmd, sig os.Signal) {
+	if err := cmd.Process.Signal(sig); err != nil {
+		cmd.Process.Kill()
+	}
+}
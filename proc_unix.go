@@ -0,0 +1,61 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// exitSignals are the signals that make Watch clean up and exit.
+var exitSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// signalNamed returns the signal with the given name, such as TERM or SIGTERM.
+func signalNamed(name string) (os.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// setpgid arranges for cmd to run in its own process group,
+// so that kill can reach any children it starts.
+func setpgid(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// kill kills cmd's process group.
+func kill(cmd *exec.Cmd) {
+	signalGroup(cmd, syscall.SIGKILL)
+}
+
+// terminate asks cmd's process group to exit.
+func terminate(cmd *exec.Cmd) {
+	signalGroup(cmd, syscall.SIGTERM)
+}
+
+// signalGroup sends sig to cmd's process group.
+func signalGroup(cmd *exec.Cmd, sig os.Signal) {
+	if s, ok := sig.(syscall.Signal); ok && syscall.Kill(-cmd.Process.Pid, s) == nil {
+		return
+	}
+	cmd.Process.Signal(sig)
+}
@@ -0,0 +1,55 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// profiles holds the files written by -cpuprofile and -trace.
+var profiles []*os.File
+
+// startProfiles starts the CPU profile and execution trace
+// asked for by -cpuprofile and -trace.
+func startProfiles() {
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal(err)
+		}
+		profiles = append(profiles, f)
+	}
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := trace.Start(f); err != nil {
+			log.Fatal(err)
+		}
+		profiles = append(profiles, f)
+	}
+}
+
+// stopProfiles stops any profiling and closes the files,
+// before Watch exits.
+func stopProfiles() {
+	if *cpuProfile != "" {
+		pprof.StopCPUProfile()
+	}
+	if *traceFile != "" {
+		trace.Stop()
+	}
+	for _, f := range profiles {
+		f.Close()
+	}
+	profiles = nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"9fans.net/go/acme"
+)
+
+// runLog is the file opened by -log, or nil.
+var runLog *os.File
+
+// A runRecord is the line written to the -log file for each run.
+type runRecord struct {
+	Time     time.Time `json:"time"`
+	File     string    `json:"file,omitempty"` // file that triggered the run
+	Command  string    `json:"command"`
+	Exit     int       `json:"exit"`
+	Duration float64   `json:"duration"` // in seconds
+}
+
+// openRunLog opens name for appending run records.
+func openRunLog(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	runLog = f
+	return nil
+}
+
+// logRun appends a record of a finished run to the -log file, if any.
+func logRun(event *acme.LogEvent, line string, start time.Time, err error) {
+	if runLog == nil {
+		return
+	}
+	rec := runRecord{
+		Time:     start,
+		Command:  line,
+		Exit:     exitCode(err),
+		Duration: time.Since(start).Seconds(),
+	}
+	if event != nil {
+		rec.File = event.Name
+	}
+	b, _ := json.Marshal(rec)
+	if _, err := runLog.Write(append(b, '\n')); err != nil {
+		log.Print(err)
+	}
+}
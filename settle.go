@@ -0,0 +1,71 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// saveSettle is how long after a run is requested for a file that
+// further events for the same file are taken to belong to the same
+// save, as when an editor writes a temporary file and renames it
+// over the original.
+const saveSettle = 500 * time.Millisecond
+
+// saveTarget returns the file an editor is saving when it writes name,
+// undoing the decorations editors commonly give temporary and
+// backup files.
+func saveTarget(name string) string {
+	dir, base := filepath.Split(name)
+	switch {
+	case strings.HasPrefix(base, ".#"): // emacs lock file
+		base = base[2:]
+	case len(base) > 2 && strings.HasPrefix(base, "#") && strings.HasSuffix(base, "#"): // emacs auto-save
+		base = base[1 : len(base)-1]
+	case strings.HasSuffix(base, "~"): // backup
+		base = strings.TrimSuffix(base, "~")
+	case strings.HasSuffix(base, ".swp"), strings.HasSuffix(base, ".swx"): // vim swap file
+		base = strings.TrimPrefix(base[:len(base)-4], ".")
+	case strings.HasSuffix(base, ".tmp"):
+		base = strings.TrimSuffix(base, ".tmp")
+	}
+	return dir + base
+}
+
+// A save records the state of a file when a run was requested for it.
+type save struct {
+	at    time.Time
+	mtime time.Time
+	size  int64
+}
+
+// saves tracks recent saves by target file, so that the events of
+// one save coalesce into a single run.
+type saves map[string]save
+
+// record notes that a run has been requested for the named target.
+func (s saves) record(target string) {
+	sv := save{at: time.Now()}
+	if fi, err := os.Stat(target); err == nil {
+		sv.mtime, sv.size = fi.ModTime(), fi.Size()
+	}
+	s[target] = sv
+}
+
+// repeat reports whether an event for target is part of a save already
+// handled: one recorded within saveSettle, after which the file is
+// unchanged.
+func (s saves) repeat(target string) bool {
+	sv, ok := s[target]
+	if !ok || time.Since(sv.at) >= saveSettle {
+		delete(s, target)
+		return false
+	}
+	fi, err := os.Stat(target)
+	return err == nil && fi.ModTime().Equal(sv.mtime) && fi.Size() == sv.size
+}
@@ -0,0 +1,77 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// sessionArgs holds the command-line arguments of this session,
+// as given or as restored by -resume.
+var sessionArgs = os.Args[1:]
+
+// A session is what -resume restores: the directory Watch ran in
+// and its arguments, flags and command.
+type session struct {
+	Dir  string   `json:"dir"`
+	Args []string `json:"args"`
+}
+
+// stateFile returns the name of the file holding the last session.
+func stateFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "Watch", "session"), nil
+}
+
+// saveState records the session for -resume. Watch calls it when it
+// shuts down cleanly. A -dry-run session is not recorded, since
+// resuming it would only repeat the dry run, nor is a -stdin session,
+// whose script is not among its arguments.
+func saveState() {
+	if *dryRun || *fromStdin {
+		return
+	}
+	name, err := stateFile()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	dir, _ := os.Getwd()
+	b, _ := json.Marshal(session{Dir: dir, Args: sessionArgs})
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		log.Print(err)
+		return
+	}
+	if err := os.WriteFile(name, append(b, '\n'), 0666); err != nil {
+		log.Print(err)
+	}
+}
+
+// loadState returns the last session saved.
+func loadState() (*session, error) {
+	name, err := stateFile()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, errors.New("no session to resume")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s session
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
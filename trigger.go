@@ -0,0 +1,51 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"strings"
+
+	"9fans.net/go/acme"
+)
+
+// readTriggers requests a run for each line written to the named FIFO,
+// with the line as the name of the changed file. An empty line requests
+// a run with no file, like Get. The FIFO is opened for writing too, so
+// that it stays open as its writers come and go; it is closed, ending
+// the loop, once ctx is done.
+func readTriggers(ctx context.Context, name string) {
+	info, err := os.Stat(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		log.Fatalf("-trigger-fifo: %s is not a named pipe", name)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	context.AfterFunc(ctx, func() { f.Close() })
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e *acme.LogEvent
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			e = &acme.LogEvent{Op: "fifo", Name: line}
+		}
+		select {
+		case changed <- e:
+		case <-ctx.Done():
+			return
+		}
+	}
+	if err := s.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("%s: %v", name, err)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and commit describe the build. They may be set with
+//
+//	go build -ldflags "-X main.version=v1.2 -X main.commit=$(git rev-parse HEAD)"
+//
+// Otherwise commit is taken from the build's version control
+// information, when the go command recorded it.
+var (
+	version = "devel"
+	commit  = ""
+)
+
+// printVersion prints the version, commit, and Go version, for -version.
+func printVersion() {
+	c := commit
+	if c == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range info.Settings {
+				if s.Key == "vcs.revision" {
+					c = s.Value
+				}
+			}
+		}
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	fmt.Printf("Watch %s (commit %s, %s)\n", version, c, runtime.Version())
+}
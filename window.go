@@ -0,0 +1,383 @@
+// Copyright 2012 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	"9fans.net/go/acme"
+)
+
+// The functions in this file manage the acme window. Except for
+// events, they must be called with run locked.
+
+// openWindow creates the window, or with -reuse takes over an existing
+// one of the same name, and starts handling its events.
+func openWindow() error {
+	w, err := reusedWindow()
+	if err != nil {
+		return err
+	}
+	if w == nil {
+		w, err = acme.New()
+		if err != nil {
+			return err
+		}
+	}
+	win = w
+	run.lines = 0
+	showState()
+	w.Ctl("clean")
+	showTag()
+	go events(w)
+	return nil
+}
+
+// openErrWindow creates the window for standard error, with -split-streams.
+func openErrWindow() error {
+	w, err := acme.New()
+	if err != nil {
+		return err
+	}
+	w.Name(winTitle + ".err")
+	w.Ctl("clean")
+	errWin = w
+	go func() {
+		for e := range w.EventChan() {
+			if e.C2 == 'x' || e.C2 == 'X' {
+				if string(e.Text) == "Del" {
+					w.Ctl("delete")
+				}
+			}
+			w.WriteEvent(e)
+		}
+		run.Lock()
+		if errWin == w {
+			errWin = nil // standard error now goes to the main window
+		}
+		run.Unlock()
+	}()
+	return nil
+}
+
+// reusedWindow returns the existing window named winTitle, emptied,
+// or nil if there is none or -reuse is not set.
+func reusedWindow() (*acme.Win, error) {
+	if !*reuse {
+		return nil, nil
+	}
+	ws, err := acme.Windows()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range ws {
+		if info.Name != winTitle && !strings.HasPrefix(info.Name, winTitle+":") {
+			continue
+		}
+		w, err := acme.Open(info.ID, nil)
+		if err != nil {
+			return nil, err
+		}
+		w.Addr(",")
+		w.Write("data", nil)
+		return w, nil
+	}
+	return nil, nil
+}
+
+// closeWindow deletes the window, if there is one.
+func closeWindow() {
+	if win != nil {
+		w := win
+		win = nil
+		w.Ctl("delete")
+	}
+}
+
+// showWindow opens the window, filling it with the output held
+// while there was none.
+func showWindow() {
+	if err := openWindow(); err != nil {
+		log.Print(err)
+		return
+	}
+	run.buffering = false
+	bodyWrite(run.hidden.Bytes())
+	run.hidden.Reset()
+	scroll()
+	win.Ctl("clean")
+}
+
+// showTag fills the window's tag with its commands followed by the
+// name of the last file whose change triggered a run, so that the
+// file can be opened from the tag.
+func showTag() {
+	if win == nil {
+		return
+	}
+	win.Ctl("cleartag")
+	tag := "Get Again Stop Kill Clear Reload "
+	if run.awaiting {
+		tag = "Run " + tag
+	}
+	if run.last != nil {
+		tag += acmeName(run.last.Name) + " "
+	}
+	win.Fprintf("tag", "%s", tag)
+}
+
+// windowOutput shows runs in the window.
+var windowOutput = output{
+	begin:    beginWindow,
+	write:    windowWrite,
+	writeErr: windowWriteErr,
+	note:     bodyWrite,
+	end:      windowEnd,
+}
+
+// beginWindow readies the window for run id, clearing the output
+// of the previous run unless -clear=onsuccess or -buffer.
+func beginWindow(id int) {
+	run.hidden.Reset()
+	run.buffering = *buffer
+	if win != nil {
+		if *clearMode == "onsuccess" {
+			win.Addr("$")
+			run.mark, _, _ = win.ReadAddr()
+			run.marked = run.lines
+		} else if !*buffer {
+			win.Addr(",")
+			win.Write("data", nil)
+			run.lines = 0
+		}
+		win.Ctl("clean")
+	}
+	if errWin != nil {
+		errWin.Addr(",")
+		errWin.Write("data", nil)
+		errWin.Ctl("clean")
+	}
+}
+
+// windowWrite appends the command's output p to the body.
+func windowWrite(p []byte) {
+	bodyWrite(p)
+	if *follow {
+		scroll()
+	}
+}
+
+// windowWriteErr appends the command's standard error p to the
+// -split-streams window, or to the body if there is none.
+func windowWriteErr(p []byte) {
+	if errWin != nil {
+		errWin.Write("body", p)
+	} else {
+		bodyWrite(p)
+	}
+}
+
+// windowEnd shows the end of a command's output and marks the
+// window clean.
+func windowEnd() {
+	scroll()
+	ctl("clean")
+}
+
+// setState records the state of the run, shown with -title-status.
+func setState(state string) {
+	run.state = state
+	showState()
+}
+
+// showState names the window for the state of the run.
+func showState() {
+	if win == nil {
+		return
+	}
+	if *titleStatus && run.state != "" {
+		win.Name("%s:%s", winTitle, run.state)
+	} else {
+		win.Name(winTitle)
+	}
+}
+
+// bodyWrite appends p to the window body, or holds it if there is
+// no window or the output is buffered.
+func bodyWrite(p []byte) {
+	if win == nil || run.buffering {
+		run.hidden.Write(p)
+		return
+	}
+	win.Write("body", p)
+	if *maxLines > 0 {
+		run.lines += bytes.Count(p, []byte("\n"))
+		trim()
+	}
+}
+
+// trim deletes the oldest lines of the body beyond -max-lines,
+// keeping run.mark pointing at the start of the run's output.
+func trim() {
+	excess := run.lines - *maxLines
+	if excess <= 0 {
+		return
+	}
+	if err := win.Addr("0,%d", excess); err != nil {
+		return
+	}
+	_, q1, err := win.ReadAddr()
+	if err != nil {
+		return
+	}
+	win.Write("data", nil)
+	run.lines -= excess
+	run.mark -= q1
+	run.marked -= excess
+	if run.mark < 0 {
+		run.mark, run.marked = 0, 0
+	}
+}
+
+func bodyPrintf(format string, args ...interface{}) {
+	bodyWrite([]byte(fmt.Sprintf(format, args...)))
+}
+
+// flushBuffer ends buffering with -buffer, writing the run's output
+// to the body in one write, in place of the earlier output unless
+// -clear=onsuccess. Without a window, the output stays held.
+func flushBuffer() {
+	run.buffering = false
+	if win == nil {
+		return
+	}
+	if *clearMode == "onsuccess" {
+		bodyWrite(run.hidden.Bytes())
+	} else {
+		win.Addr(",")
+		win.Write("data", run.hidden.Bytes())
+		run.lines = bytes.Count(run.hidden.Bytes(), []byte("\n"))
+		if *maxLines > 0 {
+			trim()
+		}
+	}
+	run.hidden.Reset()
+	scroll()
+	win.Ctl("clean")
+}
+
+// ctl writes msg to the window's ctl file, if there is a window.
+func ctl(msg string) {
+	if win != nil {
+		win.Ctl(msg)
+	}
+}
+
+// scroll positions the window after output is written: at the top
+// by default, at the end with -follow, or not at all with -no-scroll.
+func scroll() {
+	if win == nil {
+		return
+	}
+	switch {
+	case *noScroll:
+		return
+	case *follow:
+		win.Fprintf("addr", "$")
+	default:
+		win.Fprintf("addr", "#0")
+	}
+	win.Ctl("dot=addr")
+	win.Ctl("show")
+}
+
+// clearWindow empties the window body without rerunning the command.
+func clearWindow() {
+	run.Lock()
+	defer run.Unlock()
+	if win != nil {
+		win.Addr(",")
+		win.Write("data", nil)
+		win.Ctl("clean")
+	}
+	run.mark = 0
+	run.lines = 0
+	run.marked = 0
+}
+
+// deleting prepares for Del to delete the window, killing the running
+// command. With -keepalive, if a command is running, it leaves the
+// command alone, says so in the window, and reports false.
+func deleting() bool {
+	run.Lock()
+	defer run.Unlock()
+	if run.cmd == nil {
+		return true
+	}
+	if *keepalive {
+		bodyPrintf("# still running; Stop or Kill it before Del\n")
+		return false
+	}
+	kill(run.cmd)
+	run.stopped = "killed"
+	return true
+}
+
+// events handles the events of window w. When the window is deleted
+// other than by closeWindow, whether by Del or from acme itself, Watch
+// quits, ending the running command.
+func events(w *acme.Win) {
+	for e := range w.EventChan() {
+		switch e.C2 {
+		case 'x', 'X': // execute
+			switch string(e.Text) {
+			case "Get":
+				changed <- nil
+				continue
+			case "Run":
+				confirmed <- true
+				continue
+			case "Reload":
+				if reload() {
+					changed <- nil
+				}
+				continue
+			case "Again":
+				run.Lock()
+				last := run.last
+				run.Unlock()
+				rerun <- last
+				continue
+			case "Stop":
+				stop(terminate, "stopped")
+				continue
+			case "Kill":
+				stop(kill, "killed")
+				continue
+			case "Clear":
+				clearWindow()
+				continue
+			case "Del":
+				if !deleting() {
+					continue
+				}
+				w.Ctl("delete")
+			}
+		}
+		w.WriteEvent(e)
+	}
+	run.Lock()
+	gone := w == win
+	if gone {
+		win = nil // deleted, by Del or from acme; write nothing more to it
+	}
+	run.Unlock()
+	if gone {
+		quit()
+	}
+}